@@ -0,0 +1,41 @@
+-- 开始处理，返回之前的状态，处理成功的还会返回保存的结果
+local key = KEYS[1]
+-- 执行权的租期，单位毫秒
+local lease = tonumber(ARGV[1])
+-- 请求的指纹，空字符串表示不校验
+local fp = ARGV[2]
+-- 这一次执行的标识，拿到执行权的时候写进去
+local token = ARGV[3]
+
+local typ = redis.call('TYPE', key)['ok']
+if typ == 'none' then
+    redis.call('HSET', key, 'state', 'in_progress', 'fp', fp, 'token', token)
+    redis.call('PEXPIRE', key, lease)
+    return {'new'}
+end
+if typ ~= 'hash' then
+    -- Exists 写入的 key
+    return {'completed'}
+end
+
+local vals = redis.call('HMGET', key, 'state', 'fp', 'result')
+local state, storedFp, result = vals[1], vals[2], vals[3]
+if fp ~= '' and storedFp and storedFp ~= '' and storedFp ~= fp then
+    return {'mismatch'}
+end
+if state == 'failed' then
+    -- 上一次失败了，重新拿到执行权
+    redis.call('HSET', key, 'state', 'in_progress', 'token', token)
+    if fp ~= '' then
+        redis.call('HSET', key, 'fp', fp)
+    end
+    redis.call('PEXPIRE', key, lease)
+    return {'failed'}
+end
+if state == 'in_progress' then
+    return {'in_progress'}
+end
+if result then
+    return {'completed', result}
+end
+return {'completed'}
@@ -0,0 +1,226 @@
+package idempotent
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+//go:embed bloom_bitmap.lua
+var luaBloomBitmap string
+
+var bloomBitmapScript = redis.NewScript(luaBloomBitmap)
+
+// maxBloomBits Redis 字符串最大 512MB，也就是 2^32 个位
+const maxBloomBits = 1 << 32
+
+// bloomHashSeed 第二个哈希函数的种子，修改之后已有的位图全部失效
+const bloomHashSeed = 0x9e3779b97f4a7c15
+
+// bloomHasher 根据预期容量和误判率计算位数组大小和哈希函数个数，并计算 key 对应的位置
+type bloomHasher struct {
+	// 位数组大小
+	bits uint64
+	// 哈希函数个数
+	hashes int
+}
+
+func newBloomHasher(capacity uint64, errorRate float64) (bloomHasher, error) {
+	if err := validateBloomConfig(capacity, errorRate); err != nil {
+		return bloomHasher{}, err
+	}
+	bits := math.Ceil(-float64(capacity) * math.Log(errorRate) / (math.Ln2 * math.Ln2))
+	bits = min(max(bits, 64), maxBloomBits)
+	hashes := int(math.Max(math.Round(bits/float64(capacity)*math.Ln2), 1))
+	return bloomHasher{
+		bits:   uint64(bits),
+		hashes: hashes,
+	}, nil
+}
+
+// validateBloomConfig 容量必须大于 0，误判率必须在 (0, 1) 之间
+func validateBloomConfig(capacity uint64, errorRate float64) error {
+	if capacity == 0 {
+		return fmt.Errorf("idempotent: 布隆过滤器的容量必须大于 0")
+	}
+	// NaN 和任何数比较都是 false，这里也会被拒绝
+	if !(errorRate > 0 && errorRate < 1) {
+		return fmt.Errorf("idempotent: 布隆过滤器的误判率必须在 (0, 1) 之间，实际是 %v", errorRate)
+	}
+	return nil
+}
+
+// locations 使用双重哈希从两个不同种子的 xxhash 推导出 hashes 个位置
+func (h bloomHasher) locations(key string) []uint64 {
+	h1 := xxhash.Sum64String(key)
+	d := xxhash.NewWithSeed(bloomHashSeed)
+	_, _ = d.WriteString(key)
+	// 步长是奇数，避免位置出现短周期
+	h2 := d.Sum64() | 1
+	res := make([]uint64, h.hashes)
+	for i := range res {
+		res[i] = (h1 + uint64(i)*h2) % h.bits
+	}
+	return res
+}
+
+var _ ManageableIdempotencyService = (*BitmapBloomIdempotencyService)(nil)
+
+// BitmapBloomIdempotencyService 在普通 Redis 的位图上实现的布隆过滤器，不依赖 RedisBloom 模块
+// 检查和添加在同一个 lua 脚本里面完成，位图大小受 Redis 字符串的限制，最多 2^32 位
+type BitmapBloomIdempotencyService struct {
+	client redis.Cmdable
+	key    string
+	hasher bloomHasher
+}
+
+// NewBitmapBloomIdempotencyService capacity 为 0 或者 errorRate 不在 (0, 1) 之间的时候会 panic
+func NewBitmapBloomIdempotencyService(client redis.Cmdable, key string, capacity uint64, errorRate float64) *BitmapBloomIdempotencyService {
+	hasher, err := newBloomHasher(capacity, errorRate)
+	if err != nil {
+		panic(err)
+	}
+	return &BitmapBloomIdempotencyService{
+		client: client,
+		key:    key,
+		hasher: hasher,
+	}
+}
+
+func (s *BitmapBloomIdempotencyService) Exists(ctx context.Context, key string) (bool, error) {
+	res, err := s.MExists(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	return res[0], nil
+}
+
+func (s *BitmapBloomIdempotencyService) MExists(ctx context.Context, keys ...string) ([]bool, error) {
+	if len(keys) == 0 {
+		return []bool{}, nil
+	}
+	args := make([]any, 0, 1+len(keys)*s.hasher.hashes)
+	args = append(args, s.hasher.hashes)
+	for _, key := range keys {
+		for _, loc := range s.hasher.locations(key) {
+			args = append(args, strconv.FormatUint(loc, 10))
+		}
+	}
+	vals, err := bloomBitmapScript.Run(ctx, s.client, []string{s.key}, args...).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]bool, len(vals))
+	for i, val := range vals {
+		results[i] = val == 1
+	}
+	return results, nil
+}
+
+func (s *BitmapBloomIdempotencyService) Peek(ctx context.Context, key string) (bool, error) {
+	pipe := s.client.Pipeline()
+	locations := s.hasher.locations(key)
+	cmds := make([]*redis.IntCmd, 0, len(locations))
+	for _, loc := range locations {
+		cmds = append(cmds, pipe.GetBit(ctx, s.key, int64(loc)))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	for _, cmd := range cmds {
+		if cmd.Val() == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Release 布隆过滤器不支持删除，返回 ErrUnsupported
+func (s *BitmapBloomIdempotencyService) Release(ctx context.Context, key string) error {
+	return ErrUnsupported
+}
+
+// Forget 布隆过滤器不支持删除，返回 ErrUnsupported
+func (s *BitmapBloomIdempotencyService) Forget(ctx context.Context, keys ...string) error {
+	return ErrUnsupported
+}
+
+var _ ManageableIdempotencyService = (*MemoryBloomIdempotencyService)(nil)
+
+// MemoryBloomIdempotencyService 本地内存的布隆过滤器，和 BitmapBloomIdempotencyService 使用相同的哈希方式
+type MemoryBloomIdempotencyService struct {
+	mu     sync.Mutex
+	bitset []uint64
+	hasher bloomHasher
+}
+
+// NewMemoryBloomIdempotencyService capacity 为 0 或者 errorRate 不在 (0, 1) 之间的时候会 panic
+func NewMemoryBloomIdempotencyService(capacity uint64, errorRate float64) *MemoryBloomIdempotencyService {
+	hasher, err := newBloomHasher(capacity, errorRate)
+	if err != nil {
+		panic(err)
+	}
+	return &MemoryBloomIdempotencyService{
+		bitset: make([]uint64, (hasher.bits+63)/64),
+		hasher: hasher,
+	}
+}
+
+func (s *MemoryBloomIdempotencyService) Exists(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.testAndSet(key), nil
+}
+
+func (s *MemoryBloomIdempotencyService) MExists(ctx context.Context, keys ...string) ([]bool, error) {
+	if len(keys) == 0 {
+		return []bool{}, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := make([]bool, len(keys))
+	for i, key := range keys {
+		results[i] = s.testAndSet(key)
+	}
+	return results, nil
+}
+
+func (s *MemoryBloomIdempotencyService) Peek(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, loc := range s.hasher.locations(key) {
+		if s.bitset[loc/64]&(uint64(1)<<(loc%64)) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Release 布隆过滤器不支持删除，返回 ErrUnsupported
+func (s *MemoryBloomIdempotencyService) Release(ctx context.Context, key string) error {
+	return ErrUnsupported
+}
+
+// Forget 布隆过滤器不支持删除，返回 ErrUnsupported
+func (s *MemoryBloomIdempotencyService) Forget(ctx context.Context, keys ...string) error {
+	return ErrUnsupported
+}
+
+// testAndSet 返回 key 是否可能已经存在，并把 key 加入过滤器，调用者需要持有 mu
+func (s *MemoryBloomIdempotencyService) testAndSet(key string) bool {
+	exists := true
+	for _, loc := range s.hasher.locations(key) {
+		word, mask := loc/64, uint64(1)<<(loc%64)
+		if s.bitset[word]&mask == 0 {
+			exists = false
+			s.bitset[word] |= mask
+		}
+	}
+	return exists
+}
@@ -0,0 +1,20 @@
+-- 基于 SETBIT/GETBIT 的布隆过滤器，检查并添加一批 key
+-- 位图
+local key = KEYS[1]
+-- 每个 key 的哈希函数个数
+local k = tonumber(ARGV[1])
+
+local res = {}
+local n = (#ARGV - 1) / k
+for i = 0, n - 1 do
+    local exists = 1
+    for j = 1, k do
+        local offset = ARGV[1 + i * k + j]
+        if redis.call('GETBIT', key, offset) == 0 then
+            exists = 0
+            redis.call('SETBIT', key, offset, 1)
+        end
+    end
+    res[i + 1] = exists
+end
+return res
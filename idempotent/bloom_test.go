@@ -0,0 +1,139 @@
+package idempotent
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitmapBloomImplementation(t *testing.T) {
+	IdempotencyServiceTest{
+		Name: "BitmapBloomIdempotencyService",
+		NewService: func() (IdempotencyService, func(), error) {
+			mr, err := miniredis.Run()
+			if err != nil {
+				return nil, nil, err
+			}
+			client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			return NewBitmapBloomIdempotencyService(client, "bloom", 10000, 0.01), mr.Close, nil
+		},
+	}.RunTests(t)
+}
+
+func TestMemoryBloomImplementation(t *testing.T) {
+	IdempotencyServiceTest{
+		Name: "MemoryBloomIdempotencyService",
+		NewService: func() (IdempotencyService, func(), error) {
+			return NewMemoryBloomIdempotencyService(10000, 0.01), func() {}, nil
+		},
+	}.RunTests(t)
+}
+
+func TestNewBloomHasher(t *testing.T) {
+	testCases := []struct {
+		name       string
+		capacity   uint64
+		errorRate  float64
+		wantBits   uint64
+		wantHashes int
+	}{
+		{
+			name:       "百分之一",
+			capacity:   10000,
+			errorRate:  0.01,
+			wantBits:   95851,
+			wantHashes: 7,
+		},
+		{
+			name:       "千分之一",
+			capacity:   1000000,
+			errorRate:  0.001,
+			wantBits:   14377588,
+			wantHashes: 10,
+		},
+		{
+			name:       "最少 64 位",
+			capacity:   1,
+			errorRate:  0.5,
+			wantBits:   64,
+			wantHashes: 44,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h, err := newBloomHasher(tc.capacity, tc.errorRate)
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantBits, h.bits)
+			assert.Equal(t, tc.wantHashes, h.hashes)
+		})
+	}
+}
+
+func TestBloomHasher_Invalid(t *testing.T) {
+	testCases := []struct {
+		name      string
+		capacity  uint64
+		errorRate float64
+	}{
+		{name: "容量为 0", capacity: 0, errorRate: 0.01},
+		{name: "误判率为 0", capacity: 1000, errorRate: 0},
+		{name: "误判率为负数", capacity: 1000, errorRate: -0.1},
+		{name: "误判率为 1", capacity: 1000, errorRate: 1},
+		{name: "误判率为 NaN", capacity: 1000, errorRate: math.NaN()},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newBloomHasher(tc.capacity, tc.errorRate)
+			assert.Error(t, err)
+			assert.Panics(t, func() {
+				NewMemoryBloomIdempotencyService(tc.capacity, tc.errorRate)
+			})
+			assert.Panics(t, func() {
+				NewBloomIdempotencyService(nil, "filter", tc.capacity, tc.errorRate)
+			})
+		})
+	}
+}
+
+func TestBloom_FalsePositiveRate(t *testing.T) {
+	const capacity = 10000
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	bitmap := NewBitmapBloomIdempotencyService(client, "bloom", capacity, 0.01)
+	memory := NewMemoryBloomIdempotencyService(capacity, 0.01)
+	ctx := t.Context()
+
+	keys := make([]string, capacity)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+	}
+	_, err := bitmap.MExists(ctx, keys...)
+	require.NoError(t, err)
+	_, err = memory.MExists(ctx, keys...)
+	require.NoError(t, err)
+
+	// 检查的同时也会写入，只检查少量 key 避免过滤器被继续填满
+	others := make([]string, capacity/10)
+	for i := range others {
+		others[i] = "other-" + strconv.Itoa(i)
+	}
+	bitmapRes, err := bitmap.MExists(ctx, others...)
+	require.NoError(t, err)
+	memoryRes, err := memory.MExists(ctx, others...)
+	require.NoError(t, err)
+	// 两种实现的哈希方式一致，结果也一致
+	assert.Equal(t, bitmapRes, memoryRes)
+
+	falsePositives := 0
+	for _, exists := range memoryRes {
+		if exists {
+			falsePositives++
+		}
+	}
+	assert.Less(t, float64(falsePositives)/float64(len(others)), 0.02)
+}
@@ -0,0 +1,30 @@
+-- 标记处理成功，并保存处理结果，只有持有执行权的请求才能标记
+local key = KEYS[1]
+-- 过期时间，单位毫秒，小于等于 0 表示不过期
+local expiry = tonumber(ARGV[1])
+-- Begin 返回的执行标识
+local token = ARGV[2]
+-- 是否有处理结果
+local hasResult = ARGV[3] == '1'
+local result = ARGV[4]
+
+if redis.call('TYPE', key)['ok'] ~= 'hash' then
+    return 0
+end
+local vals = redis.call('HMGET', key, 'state', 'token')
+if vals[1] ~= 'in_progress' or vals[2] ~= token then
+    -- 租期过了之后被其它请求拿走，或者已经处理完了，不能覆盖别人的记录
+    return 0
+end
+redis.call('HSET', key, 'state', 'completed')
+redis.call('HDEL', key, 'token')
+if hasResult then
+    redis.call('HSET', key, 'result', result)
+end
+if expiry > 0 then
+    redis.call('PEXPIRE', key, expiry)
+else
+    -- 去掉 Begin 设置的租期，PEXPIRE 0 会直接删掉记录
+    redis.call('PERSIST', key)
+end
+return 1
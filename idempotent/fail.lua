@@ -0,0 +1,24 @@
+-- 标记处理失败，只有持有执行权的请求才能标记，已经处理成功的不会被覆盖
+local key = KEYS[1]
+-- 过期时间，单位毫秒，小于等于 0 表示不过期
+local expiry = tonumber(ARGV[1])
+-- Begin 返回的执行标识
+local token = ARGV[2]
+
+if redis.call('TYPE', key)['ok'] ~= 'hash' then
+    return 0
+end
+local vals = redis.call('HMGET', key, 'state', 'token')
+if vals[1] ~= 'in_progress' or vals[2] ~= token then
+    -- 租期过了之后被其它请求拿走，或者已经处理完了
+    return 0
+end
+redis.call('HSET', key, 'state', 'failed')
+redis.call('HDEL', key, 'token')
+if expiry > 0 then
+    redis.call('PEXPIRE', key, expiry)
+else
+    -- 去掉 Begin 设置的租期，PEXPIRE 0 会直接删掉记录
+    redis.call('PERSIST', key)
+end
+return 1
@@ -0,0 +1,259 @@
+package httpx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/rermrf/emo/idempotent"
+	"github.com/rermrf/emo/logger"
+)
+
+const (
+	// HeaderIdempotencyKey 请求中携带幂等键的 header
+	HeaderIdempotencyKey = "Idempotency-Key"
+	// HeaderIdempotentReplayed 重放的响应会带上这个 header
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+)
+
+// Middleware 基于 Idempotency-Key header 的幂等中间件，语义参考 IETF 的 idempotency-key 草案：
+//   - 缺少 header 并且要求必须携带时返回 400
+//   - 同一个 key 正在处理时返回 409
+//   - 同一个 key 用在了不同的请求体上时返回 422
+//   - 请求体超过大小限制时返回 413
+//   - 已经处理完成的请求重放第一次的状态码、header 和响应体
+//
+// 如果 svc 没有实现 idempotent.StatefulIdempotencyService，只能知道 key 是否出现过，
+// 这时所有重复的请求都返回 409，并且处理失败之后也不能重试
+// 需要监控的时候使用 idempotent.NewObservableStatefulIdempotencyService 装饰，才能保留两阶段的语义
+type Middleware struct {
+	l   logger.Logger
+	svc idempotent.IdempotencyService
+	// 限定 key 的作用域，避免不同用户、不同接口的 key 冲突
+	scope func(r *http.Request) string
+	// 缺少 header 时是否拒绝请求
+	required bool
+	// 需要做幂等的 HTTP 方法
+	methods map[string]struct{}
+	// 计算指纹时读取的请求体的大小上限，单位字节，小于等于 0 表示不限制
+	maxBodySize int64
+}
+
+// Option Middleware 的配置项
+type Option func(m *Middleware)
+
+// WithScope 设置 key 的作用域，例如按照用户 ID 隔离，默认是 HTTP 方法加上路径
+func WithScope(scope func(r *http.Request) string) Option {
+	return func(m *Middleware) {
+		m.scope = scope
+	}
+}
+
+// WithRequired 缺少 Idempotency-Key 的请求直接返回 400，默认不带 header 的请求直接放行
+func WithRequired() Option {
+	return func(m *Middleware) {
+		m.required = true
+	}
+}
+
+// WithMethods 设置需要做幂等的 HTTP 方法，默认是 POST 和 PATCH
+func WithMethods(methods ...string) Option {
+	return func(m *Middleware) {
+		m.methods = make(map[string]struct{}, len(methods))
+		for _, method := range methods {
+			m.methods[method] = struct{}{}
+		}
+	}
+}
+
+// WithMaxBodySize 设置请求体的大小上限，默认是 1MB，小于等于 0 表示不限制
+// 计算指纹需要把整个请求体读到内存里面，超过上限的请求直接返回 413
+func WithMaxBodySize(size int64) Option {
+	return func(m *Middleware) {
+		m.maxBodySize = size
+	}
+}
+
+func NewMiddleware(l logger.Logger, svc idempotent.IdempotencyService, opts ...Option) *Middleware {
+	m := &Middleware{
+		l:   l,
+		svc: svc,
+		scope: func(r *http.Request) string {
+			return r.Method + " " + r.URL.Path
+		},
+		methods: map[string]struct{}{
+			http.MethodPost:  {},
+			http.MethodPatch: {},
+		},
+		maxBodySize: 1 << 20,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Handler 包装 next
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := m.methods[r.Method]; !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		header := r.Header.Get(HeaderIdempotencyKey)
+		if header == "" {
+			if m.required {
+				http.Error(w, "缺少 Idempotency-Key", http.StatusBadRequest)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := m.scope(r) + ":" + header
+		if svc, ok := m.svc.(idempotent.StatefulIdempotencyService); ok {
+			m.serveStateful(svc, key, next, w, r)
+			return
+		}
+		m.serve(key, next, w, r)
+	})
+}
+
+// serve 只能判断 key 是否出现过
+func (m *Middleware) serve(key string, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	exists, err := m.svc.Exists(r.Context(), key)
+	if err != nil {
+		m.l.Error("检查幂等键失败", logger.Error(err), logger.String("key", key))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		http.Error(w, "重复的请求", http.StatusConflict)
+		return
+	}
+	next.ServeHTTP(w, r)
+}
+
+func (m *Middleware) serveStateful(svc idempotent.StatefulIdempotencyService, key string,
+	next http.Handler, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if m.maxBodySize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, m.maxBodySize)
+	}
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, "请求体太大", http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		http.Error(w, "读取请求体失败", http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	record, err := svc.Begin(ctx, key, idempotent.WithFingerprint(idempotent.Fingerprint(body)))
+	switch {
+	case errors.Is(err, idempotent.ErrFingerprintMismatch):
+		http.Error(w, "Idempotency-Key 已经被用在了不同的请求上", http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		m.l.Error("检查幂等键失败", logger.Error(err), logger.String("key", key))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	switch record.State {
+	case idempotent.StateInProgress:
+		http.Error(w, "请求正在处理中", http.StatusConflict)
+		return
+	case idempotent.StateCompleted:
+		m.replay(w, key, record.Result)
+		return
+	}
+
+	rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+	completed := false
+	defer func() {
+		if !completed {
+			// 业务 panic 了，允许重试
+			_ = svc.Fail(context.WithoutCancel(ctx), key, record.Token)
+		}
+	}()
+	next.ServeHTTP(rw, r)
+	completed = true
+
+	ctx = context.WithoutCancel(ctx)
+	if rw.status >= http.StatusInternalServerError {
+		// 服务端错误允许客户端用同一个 key 重试
+		if err = svc.Fail(ctx, key, record.Token); err != nil {
+			m.l.Error("标记幂等键失败", logger.Error(err), logger.String("key", key))
+		}
+		return
+	}
+	res, err := json.Marshal(recordedResponse{
+		Status: rw.status,
+		Header: rw.Header().Clone(),
+		Body:   rw.body.Bytes(),
+	})
+	if err == nil {
+		err = svc.Complete(ctx, key, record.Token, res)
+	}
+	if errors.Is(err, idempotent.ErrResultTooLarge) {
+		// 响应太大存不下，只记录已经处理完成，重复的请求会收到 409
+		err = svc.Complete(ctx, key, record.Token, nil)
+	}
+	if err != nil {
+		m.l.Error("保存幂等结果失败", logger.Error(err), logger.String("key", key))
+	}
+}
+
+func (m *Middleware) replay(w http.ResponseWriter, key string, result []byte) {
+	var resp recordedResponse
+	if len(result) == 0 || json.Unmarshal(result, &resp) != nil {
+		http.Error(w, "重复的请求", http.StatusConflict)
+		return
+	}
+	for k, vals := range resp.Header {
+		w.Header()[k] = vals
+	}
+	w.Header().Set(HeaderIdempotentReplayed, "true")
+	w.WriteHeader(resp.Status)
+	if _, err := w.Write(resp.Body); err != nil {
+		m.l.Warn("重放响应失败", logger.Error(err), logger.String("key", key))
+	}
+}
+
+// recordedResponse 保存在幂等服务里的响应
+type recordedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// recordingWriter 在写响应的同时记录下状态码和响应体
+type recordingWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
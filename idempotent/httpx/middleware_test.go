@@ -0,0 +1,186 @@
+package httpx
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"github.com/rermrf/emo/idempotent"
+	"github.com/rermrf/emo/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRedisService(t *testing.T) *idempotent.RedisIdempotencyService {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	return idempotent.NewRedisIdempotencyService(client, time.Hour)
+}
+
+func doRequest(h http.Handler, method, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/orders", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(HeaderIdempotencyKey, key)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestMiddleware_Replay(t *testing.T) {
+	var calls atomic.Int32
+	h := NewMiddleware(logger.NewNopLogger(), newRedisService(t)).Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("X-Order-Id", "123")
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write(body)
+		}))
+
+	rec := doRequest(h, http.MethodPost, "key-1", `{"amount":100}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, `{"amount":100}`, rec.Body.String())
+
+	// 重复的请求重放第一次的响应，不会再执行业务
+	rec = doRequest(h, http.MethodPost, "key-1", `{"amount":100}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, `{"amount":100}`, rec.Body.String())
+	assert.Equal(t, "123", rec.Header().Get("X-Order-Id"))
+	assert.Equal(t, "true", rec.Header().Get(HeaderIdempotentReplayed))
+	assert.Equal(t, int32(1), calls.Load())
+
+	// 同一个 key 用在了不同的请求体上
+	rec = doRequest(h, http.MethodPost, "key-1", `{"amount":200}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	// 不需要幂等的方法、不带 key 的请求直接放行
+	doRequest(h, http.MethodGet, "key-1", "")
+	doRequest(h, http.MethodPost, "", `{"amount":100}`)
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestMiddleware_Conflict(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	h := NewMiddleware(logger.NewNopLogger(), newRedisService(t)).Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.WriteHeader(http.StatusOK)
+		}))
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- doRequest(h, http.MethodPost, "key-1", "")
+	}()
+	<-started
+	// 第一个请求还在处理，并发的重复请求返回 409
+	rec := doRequest(h, http.MethodPost, "key-1", "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	close(release)
+	assert.Equal(t, http.StatusOK, (<-done).Code)
+}
+
+func TestMiddleware_RetryAfterServerError(t *testing.T) {
+	var calls atomic.Int32
+	h := NewMiddleware(logger.NewNopLogger(), newRedisService(t)).Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+
+	assert.Equal(t, http.StatusInternalServerError, doRequest(h, http.MethodPost, "key-1", "").Code)
+	// 服务端错误之后可以用同一个 key 重试
+	assert.Equal(t, http.StatusOK, doRequest(h, http.MethodPost, "key-1", "").Code)
+	assert.Equal(t, http.StatusOK, doRequest(h, http.MethodPost, "key-1", "").Code)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestMiddleware_Options(t *testing.T) {
+	var calls atomic.Int32
+	svc := newRedisService(t)
+	h := NewMiddleware(logger.NewNopLogger(), svc, WithRequired(), WithMethods(http.MethodPut),
+		WithScope(func(r *http.Request) string {
+			return r.Header.Get("X-User-Id")
+		})).Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+		}))
+
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, http.MethodPut, "", "").Code)
+	for _, user := range []string{"1", "2"} {
+		req := httptest.NewRequest(http.MethodPut, "/orders", nil)
+		req.Header.Set(HeaderIdempotencyKey, "key-1")
+		req.Header.Set("X-User-Id", user)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	// 不同用户的 key 互不影响
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestMiddleware_MaxBodySize(t *testing.T) {
+	var calls atomic.Int32
+	h := NewMiddleware(logger.NewNopLogger(), newRedisService(t), WithMaxBodySize(8)).Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+		}))
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, doRequest(h, http.MethodPost, "key-1", "123456789").Code)
+	assert.Equal(t, int32(0), calls.Load())
+	// 没有超过上限的请求不受影响，超限的请求也没有占用 key
+	assert.Equal(t, http.StatusOK, doRequest(h, http.MethodPost, "key-1", "12345678").Code)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+// existsOnly 只实现了 IdempotencyService
+type existsOnly struct {
+	idempotent.IdempotencyService
+}
+
+func TestMiddleware_ExistsOnly(t *testing.T) {
+	var calls atomic.Int32
+	h := NewMiddleware(logger.NewNopLogger(), existsOnly{newRedisService(t)}).Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+		}))
+
+	assert.Equal(t, http.StatusOK, doRequest(h, http.MethodPost, "key-1", "").Code)
+	assert.Equal(t, http.StatusConflict, doRequest(h, http.MethodPost, "key-1", "").Code)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestMiddleware_Observable(t *testing.T) {
+	var calls atomic.Int32
+	svc := idempotent.NewObservableStatefulIdempotencyService(newRedisService(t), "order",
+		idempotent.WithRegisterer(prometheus.NewRegistry()))
+	h := NewMiddleware(logger.NewNopLogger(), svc).Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte("ok"))
+		}))
+
+	// 装饰之后依旧是两阶段的语义：失败之后可以重试，成功之后重放结果
+	assert.Equal(t, http.StatusInternalServerError, doRequest(h, http.MethodPost, "key-1", "").Code)
+	assert.Equal(t, http.StatusCreated, doRequest(h, http.MethodPost, "key-1", "").Code)
+	rec := doRequest(h, http.MethodPost, "key-1", "")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "ok", rec.Body.String())
+	assert.Equal(t, "true", rec.Header().Get(HeaderIdempotentReplayed))
+	assert.Equal(t, int32(2), calls.Load())
+}
@@ -2,9 +2,12 @@ package idempotent
 
 import (
 	"context"
+	"errors"
+	"slices"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/require"
 )
@@ -22,6 +25,9 @@ func (ist IdempotencyServiceTest) RunTests(t *testing.T) {
 	t.Run("TestMExists", func(t *testing.T) {
 		ist.TestMExists(t)
 	})
+	t.Run("TestPeekReleaseForget", func(t *testing.T) {
+		ist.TestPeekReleaseForget(t)
+	})
 }
 
 func (ist IdempotencyServiceTest) TestExists(t *testing.T) {
@@ -74,57 +80,107 @@ func (ist IdempotencyServiceTest) TestMExists(t *testing.T) {
 	for i, res := range exists {
 		require.True(t, res, "Key %s should exist", keys[i])
 	}
+
+	// 空的输入返回空的结果
+	exists, err = service.MExists(ctx)
+	require.NoError(t, err)
+	require.Empty(t, exists)
 }
 
-func TestRedisImplementation(t *testing.T) {
+func (ist IdempotencyServiceTest) TestPeekReleaseForget(t *testing.T) {
 	t.Parallel()
-	t.Skip()
-	// 创建 Redis 客户端
-	client := redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-	})
-	t.Cleanup(func() {
-		client.Close()
-	})
+	svc, cleanup, err := ist.NewService()
+	require.NoError(t, err)
+	t.Cleanup(cleanup)
+	service, ok := svc.(ManageableIdempotencyService)
+	if !ok {
+		t.Skip("没有实现 ManageableIdempotencyService")
+	}
 
-	// 检查 Redis 连接
-	ctx, cancel := context.WithTimeout(t.Context(), 2*time.Second)
-	t.Cleanup(cancel)
+	ctx := t.Context()
 
-	if err := client.Ping(ctx).Err(); err != nil {
-		t.Skip("Redis server is not available, skipping test")
+	// Peek 不会添加
+	exists, err := service.Peek(ctx, "peek-key-1")
+	require.NoError(t, err)
+	require.False(t, exists)
+	exists, err = service.Exists(ctx, "peek-key-1")
+	require.NoError(t, err)
+	require.False(t, exists, "Peek should not add the key")
+	exists, err = service.Peek(ctx, "peek-key-1")
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	err = service.Release(ctx, "peek-key-1")
+	if errors.Is(err, ErrUnsupported) {
+		// 布隆过滤器之类的实现不支持删除
+		require.ErrorIs(t, service.Forget(ctx, "peek-key-1"), errors.ErrUnsupported)
 		return
 	}
+	require.NoError(t, err)
+	exists, err = service.Exists(ctx, "peek-key-1")
+	require.NoError(t, err)
+	require.False(t, exists, "Key should be released")
 
-	// 先清空所有测试相关的key
-	err := client.FlushDB(ctx).Err()
-	if err != nil {
-		t.Fatalf("Failed to flush DB: %v", err)
-		return
+	_, err = service.MExists(ctx, "peek-key-2", "peek-key-3")
+	require.NoError(t, err)
+	require.NoError(t, service.Forget(ctx, "peek-key-1", "peek-key-2", "peek-key-3"))
+	for _, key := range []string{"peek-key-1", "peek-key-2", "peek-key-3"} {
+		exists, err = service.Peek(ctx, key)
+		require.NoError(t, err)
+		require.False(t, exists, "Key %s should be forgotten", key)
 	}
+}
 
-	// 创建测试套件
-	redisTest := IdempotencyServiceTest{
+func TestRedisImplementation(t *testing.T) {
+	IdempotencyServiceTest{
 		Name: "RedisIdempotencyService",
 		NewService: func() (IdempotencyService, func(), error) {
-			// 清理测试键前缀
-			cleanup := func() {
-				ctx := t.Context()
-				iter := client.Scan(ctx, 0, "idempotency:*", 100).Iterator()
-				for iter.Next(ctx) {
-					client.Del(ctx, iter.Val())
-				}
+			mr, err := miniredis.Run()
+			if err != nil {
+				return nil, nil, err
 			}
+			client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			return NewRedisIdempotencyService(client, 10*time.Minute), mr.Close, nil
+		},
+	}.RunTests(t)
+}
 
-			cleanup()
+func TestRedisIdempotencyService_Peek(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	svc := NewRedisIdempotencyService(client, 10*time.Minute, WithLease(time.Minute))
+	ctx := t.Context()
 
-			// 创建服务实例
-			service := NewRedisIdempotencyService(client, 10*time.Minute)
-			return service, cleanup, nil
-		},
+	peek := func(key string) bool {
+		exists, err := svc.Peek(ctx, key)
+		require.NoError(t, err)
+		return exists
 	}
 
-	redisTest.RunTests(t)
+	require.False(t, peek("missing"))
+
+	_, err := svc.Exists(ctx, "exists")
+	require.NoError(t, err)
+	require.True(t, peek("exists"))
+
+	inProgress, err := svc.Begin(ctx, "in-progress")
+	require.NoError(t, err)
+	require.True(t, peek("in-progress"))
+
+	completed, err := svc.Begin(ctx, "completed")
+	require.NoError(t, err)
+	require.NoError(t, svc.Complete(ctx, "completed", completed.Token, nil))
+	require.True(t, peek("completed"))
+
+	failed, err := svc.Begin(ctx, "failed")
+	require.NoError(t, err)
+	require.NoError(t, svc.Fail(ctx, "failed", failed.Token))
+	require.False(t, peek("failed"))
+
+	// 租期过了之后处理中的记录就不存在了
+	mr.FastForward(time.Minute)
+	require.False(t, peek("in-progress"))
+	require.ErrorIs(t, svc.Fail(ctx, "in-progress", inProgress.Token), ErrLeaseLost)
 }
 
 func TestBloomFilterImplementation(t *testing.T) {
@@ -193,3 +249,327 @@ func TestBloomFilterImplementation(t *testing.T) {
 
 	bloomTest.RunTests(t)
 }
+
+type StatefulIdempotencyServiceTest struct {
+	Name string
+	// NewService lease 是执行权的租期，返回的 advance 用来让时间流逝
+	NewService func(t *testing.T, lease time.Duration) (service StatefulIdempotencyService, advance func(d time.Duration))
+}
+
+func (st StatefulIdempotencyServiceTest) RunTests(t *testing.T) {
+	t.Helper()
+	t.Run("TestBeginComplete", st.TestBeginComplete)
+	t.Run("TestBeginFail", st.TestBeginFail)
+	t.Run("TestLeaseExpired", st.TestLeaseExpired)
+	t.Run("TestStaleComplete", st.TestStaleComplete)
+	t.Run("TestResultReplay", st.TestResultReplay)
+	t.Run("TestFingerprint", st.TestFingerprint)
+}
+
+func (st StatefulIdempotencyServiceTest) TestBeginComplete(t *testing.T) {
+	service, _ := st.NewService(t, time.Minute)
+	ctx := t.Context()
+
+	record, err := service.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, StateNew, record.State)
+	require.NotEmpty(t, record.Token)
+	token := record.Token
+
+	// 并发的重复请求被拦住
+	record, err = service.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, StateInProgress, record.State)
+	require.False(t, record.State.Acquired())
+	require.Empty(t, record.Token)
+
+	require.NoError(t, service.Complete(ctx, "key", token, nil))
+	record, err = service.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, StateCompleted, record.State)
+
+	// 处理成功之后 Fail 不会覆盖结果
+	require.ErrorIs(t, service.Fail(ctx, "key", token), ErrLeaseLost)
+	record, err = service.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, StateCompleted, record.State)
+}
+
+func (st StatefulIdempotencyServiceTest) TestBeginFail(t *testing.T) {
+	service, _ := st.NewService(t, time.Minute)
+	ctx := t.Context()
+
+	record, err := service.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, StateNew, record.State)
+	require.NoError(t, service.Fail(ctx, "key", record.Token))
+
+	// 失败之后可以重试，重试期间并发的重复请求依旧被拦住
+	record, err = service.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, StateFailed, record.State)
+	require.True(t, record.State.Acquired())
+	retryToken := record.Token
+	record, err = service.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, StateInProgress, record.State)
+
+	// 同一个 token 只能标记一次失败
+	require.NoError(t, service.Fail(ctx, "key", retryToken))
+	require.ErrorIs(t, service.Fail(ctx, "key", retryToken), ErrLeaseLost)
+	record, err = service.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, StateFailed, record.State)
+
+	require.NoError(t, service.Complete(ctx, "key", record.Token, nil))
+	record, err = service.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, StateCompleted, record.State)
+}
+
+func (st StatefulIdempotencyServiceTest) TestLeaseExpired(t *testing.T) {
+	service, advance := st.NewService(t, time.Minute)
+	ctx := t.Context()
+
+	record, err := service.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, StateNew, record.State)
+
+	stale := record.Token
+
+	// 拿到执行权的请求崩溃了，租期过后其它请求可以重新拿到执行权
+	advance(2 * time.Minute)
+	record, err = service.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, StateNew, record.State)
+	require.NotEqual(t, stale, record.Token)
+
+	// 租期过了之后才返回的请求不能把正在执行的请求标记成失败
+	require.ErrorIs(t, service.Fail(ctx, "key", stale), ErrLeaseLost)
+	record, err = service.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, StateInProgress, record.State)
+}
+
+func (st StatefulIdempotencyServiceTest) TestStaleComplete(t *testing.T) {
+	service, advance := st.NewService(t, time.Minute)
+	ctx := t.Context()
+
+	record, err := service.Begin(ctx, "key")
+	require.NoError(t, err)
+	stale := record.Token
+
+	advance(2 * time.Minute)
+	record, err = service.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, StateNew, record.State)
+	current := record.Token
+
+	// 租期过了之后才返回的请求不能覆盖正在执行的请求
+	require.ErrorIs(t, service.Complete(ctx, "key", stale, []byte("stale")), ErrLeaseLost)
+	record, err = service.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, StateInProgress, record.State)
+
+	// 也不能覆盖已经处理完成的记录
+	require.NoError(t, service.Complete(ctx, "key", current, []byte("current")))
+	require.ErrorIs(t, service.Complete(ctx, "key", stale, []byte("stale")), ErrLeaseLost)
+	require.ErrorIs(t, service.Complete(ctx, "key", current, []byte("again")), ErrLeaseLost)
+	record, err = service.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, Record{State: StateCompleted, Result: []byte("current")}, record)
+
+	// 没有 Begin 过的 key
+	require.ErrorIs(t, service.Complete(ctx, "missing", stale, nil), ErrLeaseLost)
+}
+
+func (st StatefulIdempotencyServiceTest) TestResultReplay(t *testing.T) {
+	service, _ := st.NewService(t, time.Minute)
+	ctx := t.Context()
+
+	record, err := service.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, StateNew, record.State)
+	require.Nil(t, record.Result)
+
+	result := []byte(`{"order_id":123}`)
+	require.NoError(t, service.Complete(ctx, "key", record.Token, result))
+
+	// 重复的请求拿到第一次处理的结果
+	record, err = service.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, Record{State: StateCompleted, Result: result}, record)
+
+	// 超过大小限制
+	record, err = service.Begin(ctx, "large")
+	require.NoError(t, err)
+	err = service.Complete(ctx, "large", record.Token, make([]byte, 1<<20))
+	require.ErrorIs(t, err, ErrResultTooLarge)
+}
+
+func (st StatefulIdempotencyServiceTest) TestFingerprint(t *testing.T) {
+	service, _ := st.NewService(t, time.Minute)
+	ctx := t.Context()
+
+	fp := Fingerprint([]byte(`{"amount":100}`))
+	record, err := service.Begin(ctx, "key", WithFingerprint(fp))
+	require.NoError(t, err)
+	require.Equal(t, StateNew, record.State)
+	token := record.Token
+
+	// 同一个 key 用在了不同的请求上
+	_, err = service.Begin(ctx, "key", WithFingerprint(Fingerprint([]byte(`{"amount":200}`))))
+	require.ErrorIs(t, err, ErrFingerprintMismatch)
+
+	// 相同的请求或者不带指纹的请求不受影响
+	record, err = service.Begin(ctx, "key", WithFingerprint(fp))
+	require.NoError(t, err)
+	require.Equal(t, StateInProgress, record.State)
+	record, err = service.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, StateInProgress, record.State)
+
+	require.NoError(t, service.Complete(ctx, "key", token, nil))
+	_, err = service.Begin(ctx, "key", WithFingerprint(Fingerprint([]byte(`{"amount":200}`))))
+	require.ErrorIs(t, err, ErrFingerprintMismatch)
+}
+
+func TestRedisStatefulImplementation(t *testing.T) {
+	StatefulIdempotencyServiceTest{
+		Name: "RedisIdempotencyService",
+		NewService: func(t *testing.T, lease time.Duration) (StatefulIdempotencyService, func(d time.Duration)) {
+			mr := miniredis.RunT(t)
+			client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			return NewRedisIdempotencyService(client, 10*time.Minute, WithLease(lease)), mr.FastForward
+		},
+	}.RunTests(t)
+}
+
+// failSlotHook 让包含 failKey 的脚本执行失败，模拟某个 slot 所在的节点出错
+type failSlotHook struct {
+	failKey string
+}
+
+func (h failSlotHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h failSlotHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return next
+}
+
+func (h failSlotHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		remaining := make([]redis.Cmder, 0, len(cmds))
+		for _, cmd := range cmds {
+			if slices.Contains(cmd.Args(), any(h.failKey)) {
+				cmd.SetErr(errors.New("mock error"))
+				continue
+			}
+			remaining = append(remaining, cmd)
+		}
+		return next(ctx, remaining)
+	}
+}
+
+func TestRedisIdempotencyService_MExistsResults(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{mr.Addr()}})
+	// {a} 和 {b} 在不同的 slot 上
+	client.AddHook(failSlotHook{failKey: "idempotency:{b}:1"})
+	svc := NewRedisIdempotencyService(client, time.Minute)
+	ctx := t.Context()
+
+	keys := []string{"{a}:1", "{b}:1", "{a}:2", "{b}:2"}
+	results := svc.MExistsResults(ctx, keys...)
+	require.Len(t, results, 4)
+	for i, res := range results {
+		require.Equal(t, keys[i], res.Key)
+	}
+	// {a} 所在的 slot 全部成功
+	require.NoError(t, results[0].Err)
+	require.NoError(t, results[2].Err)
+	require.False(t, results[0].Exists)
+	require.False(t, results[2].Exists)
+	// {b} 所在的 slot 全部失败，没有任何 key 被记录
+	require.Error(t, results[1].Err)
+	require.Error(t, results[3].Err)
+	require.False(t, mr.Exists("idempotency:{b}:1"))
+	require.False(t, mr.Exists("idempotency:{b}:2"))
+
+	_, err := svc.MExists(ctx, keys...)
+	var mErr *MExistsError
+	require.ErrorAs(t, err, &mErr)
+	require.Len(t, mErr.Results, 4)
+	require.True(t, mErr.Results[0].Exists)
+	require.Contains(t, err.Error(), "2/4")
+}
+
+func TestRedisIdempotencyService_MExistsResultsGroupBySlot(t *testing.T) {
+	// 不是 *redis.ClusterClient 的时候也按照 slot 分组，一个 slot 出错不影响其它 slot
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	client.AddHook(failSlotHook{failKey: "idempotency:{b}:1"})
+	svc := NewRedisIdempotencyService(client, time.Minute)
+
+	results := svc.MExistsResults(t.Context(), "{a}:1", "{b}:1", "{b}:2")
+	require.NoError(t, results[0].Err)
+	require.Error(t, results[1].Err)
+	require.Error(t, results[2].Err)
+	require.True(t, mr.Exists("idempotency:{a}:1"))
+	require.False(t, mr.Exists("idempotency:{b}:2"))
+}
+
+func TestRedisIdempotencyService_NoExpiry(t *testing.T) {
+	// expiry 为 0 的时候 key 不过期，和 Exists 使用的 SETNX 一致
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	svc := NewRedisIdempotencyService(client, 0)
+	ctx := t.Context()
+
+	res, err := svc.MExists(ctx, "a", "b")
+	require.NoError(t, err)
+	require.Equal(t, []bool{false, false}, res)
+	res, err = svc.MExists(ctx, "a", "b")
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, true}, res)
+	require.Zero(t, mr.TTL("idempotency:a"))
+}
+
+func TestRedisIdempotencyService_CompleteNoExpiry(t *testing.T) {
+	// expiry 为 0 的时候处理成功的记录不过期，而不是被 PEXPIRE 0 删掉
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	svc := NewRedisIdempotencyService(client, 0, WithLease(time.Minute))
+	ctx := t.Context()
+
+	record, err := svc.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.NoError(t, svc.Complete(ctx, "key", record.Token, []byte("ok")))
+	require.Zero(t, mr.TTL("idempotency:key"))
+
+	mr.FastForward(time.Hour)
+	record, err = svc.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, StateCompleted, record.State)
+	require.Equal(t, []byte("ok"), record.Result)
+}
+
+func TestRedisIdempotencyService_FailNoExpiry(t *testing.T) {
+	// expiry 为 0 的时候处理失败的记录保留下来，而不是被 PEXPIRE 0 删掉
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	svc := NewRedisIdempotencyService(client, 0, WithLease(time.Minute))
+	ctx := t.Context()
+
+	record, err := svc.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.NoError(t, svc.Fail(ctx, "key", record.Token))
+	require.True(t, mr.Exists("idempotency:key"))
+	require.Zero(t, mr.TTL("idempotency:key"))
+
+	mr.FastForward(time.Hour)
+	record, err = svc.Begin(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, StateFailed, record.State)
+}
@@ -0,0 +1,71 @@
+package idempotent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// KeyHasher 把调用者传入的 key 转换成存储用的 key，避免消息体之类的长 key 占用过多内存
+type KeyHasher func(key string) string
+
+// SHA256KeyHasher 64 个字符的十六进制 SHA-256，基本不会冲突
+func SHA256KeyHasher(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// XXHashKeyHasher 16 个字符的十六进制 xxhash，更快更短，
+// 但是 key 的数量达到几十亿的时候冲突的概率就不能忽略了，冲突的 key 会被当成重复
+func XXHashKeyHasher(key string) string {
+	return fmt.Sprintf("%016x", xxhash.Sum64String(key))
+}
+
+// clusterSlots Redis Cluster 的 slot 个数
+const clusterSlots = 16384
+
+// hashSlot 计算 key 在 Redis Cluster 里面的 slot，和 Redis 一样只对 {} 里面的部分计算
+func hashSlot(key string) uint16 {
+	if s := strings.IndexByte(key, '{'); s > -1 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+e+1]
+		}
+	}
+	return crc16(key) % clusterSlots
+}
+
+// crc16 CRC16-CCITT (XMODEM)，Redis Cluster 使用的校验算法
+func crc16(key string) uint16 {
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// groupBySlot 按照 slot 分组，返回每一组 key 在 keys 里面的下标，组的顺序和第一次出现的顺序一致
+func groupBySlot(keys []string) [][]int {
+	groups := make([][]int, 0)
+	slots := make(map[uint16]int)
+	for i, key := range keys {
+		slot := hashSlot(key)
+		idx, ok := slots[slot]
+		if !ok {
+			idx = len(groups)
+			slots[slot] = idx
+			groups = append(groups, nil)
+		}
+		groups[idx] = append(groups[idx], i)
+	}
+	return groups
+}
@@ -0,0 +1,84 @@
+package idempotent
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashSlot(t *testing.T) {
+	testCases := []struct {
+		name string
+		key  string
+		want uint16
+	}{
+		{name: "CRC16 参考值", key: "123456789", want: 0x31c3 % clusterSlots},
+		{name: "普通 key", key: "foo", want: 12182},
+		{name: "hash tag", key: "{foo}:bar", want: 12182},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, hashSlot(tc.key))
+		})
+	}
+	// 空的 {} 不算 hash tag
+	assert.NotEqual(t, hashSlot("foo"), hashSlot("{}foo"))
+}
+
+func TestGroupBySlot(t *testing.T) {
+	groups := groupBySlot([]string{"{a}:1", "{b}:1", "{a}:2", "{b}:2", "{c}:1"})
+	assert.Equal(t, [][]int{{0, 2}, {1, 3}, {4}}, groups)
+}
+
+func TestKeyHasher(t *testing.T) {
+	assert.Len(t, SHA256KeyHasher("key"), 64)
+	assert.Equal(t, SHA256KeyHasher("key"), SHA256KeyHasher("key"))
+	assert.NotEqual(t, XXHashKeyHasher("key"), XXHashKeyHasher("key2"))
+	// 前面是 0 的哈希值也补齐到 16 个字符
+	for i := 0; i < 1000; i++ {
+		assert.Len(t, XXHashKeyHasher(strconv.Itoa(i)), 16)
+	}
+}
+
+func TestRedisIdempotencyService_Namespace(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := t.Context()
+
+	order := NewRedisIdempotencyService(client, time.Minute, WithNamespace("order:"))
+	payment := NewRedisIdempotencyService(client, time.Minute, WithNamespace("payment"), WithKeyHasher(SHA256KeyHasher))
+
+	exists, err := order.Exists(ctx, "key")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	// 不同的命名空间互不影响
+	exists, err = payment.Exists(ctx, "key")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	assert.True(t, mr.Exists("order:key"))
+	assert.True(t, mr.Exists("payment:"+SHA256KeyHasher("key")))
+	assert.False(t, mr.Exists("payment:key"))
+}
+
+func TestRedisIdempotencyService_MExistsCluster(t *testing.T) {
+	mr := miniredis.RunT(t)
+	// miniredis 可以当成只有一个节点的集群使用
+	client := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{mr.Addr()}})
+	svc := NewRedisIdempotencyService(client, time.Minute, WithKeyHasher(XXHashKeyHasher))
+	ctx := t.Context()
+
+	keys := []string{"a", "b", "c", "a"}
+	res, err := svc.MExists(ctx, keys...)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, false, false, true}, res)
+
+	res, err = svc.MExists(ctx, keys...)
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, true, true, true}, res)
+}
@@ -0,0 +1,150 @@
+package idempotent
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+var _ ManageableIdempotencyService = (*MemoryIdempotencyService)(nil)
+
+// MemoryIdempotencyService 本地内存的幂等服务，语义和 RedisIdempotencyService 一致
+// 每个 key 在 expiry 之后过期，expiry 小于等于 0 表示不过期，超过 maxEntries 之后淘汰最久没有被访问的 key
+// 适合单元测试和单机工具
+type MemoryIdempotencyService struct {
+	mu     sync.Mutex
+	expiry time.Duration
+	// 最多保存多少个 key，小于等于 0 表示不限制
+	maxEntries int
+	// 按照访问时间排序，最近访问的在前面
+	lru *list.List
+	// 按照过期时间排序，最早过期的在前面，所有 key 的 expiry 相同，所以添加的时候放到最后就可以
+	byExpiry *list.List
+	entries  map[string]*memoryEntry
+	now      func() time.Time
+}
+
+type memoryEntry struct {
+	key string
+	// 零值表示不过期
+	expireAt   time.Time
+	lruElem    *list.Element
+	expiryElem *list.Element
+}
+
+func NewMemoryIdempotencyService(expiry time.Duration, maxEntries int) *MemoryIdempotencyService {
+	return &MemoryIdempotencyService{
+		expiry:     expiry,
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		byExpiry:   list.New(),
+		entries:    make(map[string]*memoryEntry),
+		now:        time.Now,
+	}
+}
+
+func (m *MemoryIdempotencyService) Exists(ctx context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.exists(key, m.now()), nil
+}
+
+// MExists 在同一把锁里面完成所有 key 的检查和添加
+func (m *MemoryIdempotencyService) MExists(ctx context.Context, keys ...string) ([]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	results := make([]bool, len(keys))
+	for i, key := range keys {
+		results[i] = m.exists(key, now)
+	}
+	return results, nil
+}
+
+// Peek 不会更新 key 的访问时间
+func (m *MemoryIdempotencyService) Peek(ctx context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[key]
+	return ok && !entry.expired(m.now()), nil
+}
+
+func (m *MemoryIdempotencyService) Release(ctx context.Context, key string) error {
+	return m.Forget(ctx, key)
+}
+
+func (m *MemoryIdempotencyService) Forget(ctx context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		if entry, ok := m.entries[key]; ok {
+			m.remove(entry)
+		}
+	}
+	return nil
+}
+
+// Len 当前保存的 key 的个数，包含已经过期但是还没有被清理的
+func (m *MemoryIdempotencyService) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Len()
+}
+
+// exists 调用者需要持有 mu
+func (m *MemoryIdempotencyService) exists(key string, now time.Time) bool {
+	if entry, ok := m.entries[key]; ok {
+		if !entry.expired(now) {
+			m.lru.MoveToFront(entry.lruElem)
+			return true
+		}
+		// 已经过期，当作新的 key 重新添加
+		entry.expireAt = m.expireAt(now)
+		m.lru.MoveToFront(entry.lruElem)
+		m.byExpiry.MoveToBack(entry.expiryElem)
+		return false
+	}
+	entry := &memoryEntry{key: key, expireAt: m.expireAt(now)}
+	entry.lruElem = m.lru.PushFront(entry)
+	entry.expiryElem = m.byExpiry.PushBack(entry)
+	m.entries[key] = entry
+	m.evict(now)
+	return false
+}
+
+// evict 先清理已经过期的 key，超过容量时再按照 LRU 淘汰，调用者需要持有 mu
+func (m *MemoryIdempotencyService) evict(now time.Time) {
+	// 遇到第一个没有过期的 key 就可以停下来了
+	for elem := m.byExpiry.Front(); elem != nil; elem = m.byExpiry.Front() {
+		entry := elem.Value.(*memoryEntry)
+		if !entry.expired(now) {
+			break
+		}
+		m.remove(entry)
+	}
+	if m.maxEntries <= 0 {
+		return
+	}
+	for m.lru.Len() > m.maxEntries {
+		m.remove(m.lru.Back().Value.(*memoryEntry))
+	}
+}
+
+// expireAt 在 now 添加的 key 的过期时间，expiry 小于等于 0 的时候返回零值
+func (m *MemoryIdempotencyService) expireAt(now time.Time) time.Time {
+	if m.expiry <= 0 {
+		return time.Time{}
+	}
+	return now.Add(m.expiry)
+}
+
+func (m *MemoryIdempotencyService) remove(entry *memoryEntry) {
+	m.lru.Remove(entry.lruElem)
+	m.byExpiry.Remove(entry.expiryElem)
+	delete(m.entries, entry.key)
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expireAt.IsZero() && !now.Before(e.expireAt)
+}
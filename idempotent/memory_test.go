@@ -0,0 +1,176 @@
+package idempotent
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryImplementation(t *testing.T) {
+	IdempotencyServiceTest{
+		Name: "MemoryIdempotencyService",
+		NewService: func() (IdempotencyService, func(), error) {
+			return NewMemoryIdempotencyService(time.Minute, 100), func() {}, nil
+		},
+	}.RunTests(t)
+}
+
+func TestMemoryIdempotencyService_Expiry(t *testing.T) {
+	service := NewMemoryIdempotencyService(time.Minute, 0)
+	now := time.Now()
+	service.now = func() time.Time {
+		return now
+	}
+	ctx := t.Context()
+
+	exists, err := service.Exists(ctx, "key")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	now = now.Add(59 * time.Second)
+	exists, err = service.Exists(ctx, "key")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	// 访问不会延长过期时间
+	now = now.Add(time.Second)
+	exists, err = service.Exists(ctx, "key")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestMemoryIdempotencyService_LRU(t *testing.T) {
+	service := NewMemoryIdempotencyService(time.Minute, 2)
+	ctx := t.Context()
+
+	res, err := service.MExists(ctx, "a", "b")
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, false}, res)
+
+	// 访问 a 之后 b 是最久没有被访问的
+	exists, err := service.Exists(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = service.Exists(ctx, "c")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, 2, service.Len())
+
+	res, err = service.MExists(ctx, "a", "c", "b")
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, true, false}, res)
+}
+
+func TestMemoryIdempotencyService_EvictExpiredFirst(t *testing.T) {
+	service := NewMemoryIdempotencyService(time.Minute, 2)
+	now := time.Now()
+	service.now = func() time.Time {
+		return now
+	}
+	ctx := t.Context()
+
+	_, err := service.MExists(ctx, "old")
+	require.NoError(t, err)
+	now = now.Add(30 * time.Second)
+	_, err = service.MExists(ctx, "a", "old")
+	require.NoError(t, err)
+
+	// old 最近被访问过但是已经过期了，超过容量时优先淘汰 old 而不是 a
+	now = now.Add(40 * time.Second)
+	_, err = service.MExists(ctx, "b")
+	require.NoError(t, err)
+	assert.Equal(t, 2, service.Len())
+
+	res, err := service.MExists(ctx, "a", "b")
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, true}, res)
+}
+
+func TestMemoryIdempotencyService_Concurrent(t *testing.T) {
+	service := NewMemoryIdempotencyService(time.Minute, 0)
+	ctx := t.Context()
+
+	var (
+		wg       sync.WaitGroup
+		newCount atomic.Int32
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := service.MExists(ctx, "k1", "k2", "k3")
+			if err != nil {
+				return
+			}
+			for _, exists := range res {
+				if !exists {
+					newCount.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	// 每个 key 只有一次是新的
+	assert.Equal(t, int32(3), newCount.Load())
+	assert.Equal(t, 3, service.Len())
+}
+
+func TestMemoryIdempotencyService_PurgeExpired(t *testing.T) {
+	// 不限制容量的时候也会清理已经过期的 key
+	service := NewMemoryIdempotencyService(time.Minute, 0)
+	now := time.Now()
+	service.now = func() time.Time {
+		return now
+	}
+	ctx := t.Context()
+
+	_, err := service.MExists(ctx, "a", "b")
+	require.NoError(t, err)
+	now = now.Add(30 * time.Second)
+	_, err = service.MExists(ctx, "c")
+	require.NoError(t, err)
+	// 访问 a 不会延长过期时间
+	exists, err := service.Exists(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, 3, service.Len())
+
+	now = now.Add(40 * time.Second)
+	_, err = service.MExists(ctx, "d")
+	require.NoError(t, err)
+	assert.Equal(t, 2, service.Len())
+
+	res, err := service.MExists(ctx, "c", "d")
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true, true}, res)
+}
+
+func TestMemoryIdempotencyService_NoExpiry(t *testing.T) {
+	// expiry 为 0 的时候 key 不过期，和 RedisIdempotencyService 一致
+	service := NewMemoryIdempotencyService(0, 0)
+	now := time.Now()
+	service.now = func() time.Time {
+		return now
+	}
+	ctx := t.Context()
+
+	exists, err := service.Exists(ctx, "key")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	now = now.Add(24 * time.Hour)
+	exists, err = service.Exists(ctx, "key")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = service.Peek(ctx, "key")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	_, err = service.Exists(ctx, "other")
+	require.NoError(t, err)
+	assert.Equal(t, 2, service.Len())
+}
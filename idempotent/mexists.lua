@@ -0,0 +1,20 @@
+-- 批量检查并添加同一个 slot 的 key，整个脚本原子执行
+-- 返回每个 key 是否已经存在，1 表示存在
+-- 过期时间，单位毫秒，小于等于 0 表示不过期，和 SETNX 的语义一致
+local expiry = tonumber(ARGV[1])
+
+local res = {}
+for i, key in ipairs(KEYS) do
+    local ok
+    if expiry > 0 then
+        ok = redis.call('SET', key, '1', 'NX', 'PX', expiry)
+    else
+        ok = redis.call('SET', key, '1', 'NX')
+    end
+    if ok then
+        res[i] = 0
+    else
+        res[i] = 1
+    end
+end
+return res
@@ -0,0 +1,300 @@
+package idempotent
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rermrf/emo/logger"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/rermrf/emo/idempotent"
+
+var (
+	_ ManageableIdempotencyService = (*ObservableIdempotencyService)(nil)
+	_ IdempotencyService           = (*ObservableStatefulIdempotencyService)(nil)
+	_ StatefulIdempotencyService   = (*ObservableStatefulIdempotencyService)(nil)
+)
+
+// ObservableIdempotencyService 为 IdempotencyService 加上监控、追踪和重复 key 的采样日志
+// 同一个进程里面的多个实例共用一组指标，通过 service 标签区分不同的业务
+type ObservableIdempotencyService struct {
+	svc  IdempotencyService
+	name string
+
+	checked   prometheus.Counter
+	duplicate prometheus.Counter
+	duration  *prometheus.SummaryVec
+
+	tracer trace.Tracer
+
+	l logger.Logger
+	// 重复的 key 按照这个比例输出日志
+	logSampleRate float64
+}
+
+// ObservableOption ObservableIdempotencyService 的配置项
+type ObservableOption func(o *observableOptions)
+
+type observableOptions struct {
+	registerer     prometheus.Registerer
+	tracerProvider trace.TracerProvider
+	l              logger.Logger
+	logSampleRate  float64
+}
+
+// WithRegisterer 设置注册指标的 prometheus.Registerer，默认是 prometheus.DefaultRegisterer
+func WithRegisterer(registerer prometheus.Registerer) ObservableOption {
+	return func(o *observableOptions) {
+		o.registerer = registerer
+	}
+}
+
+// WithTracerProvider 设置 trace.TracerProvider，默认使用全局的
+func WithTracerProvider(tp trace.TracerProvider) ObservableOption {
+	return func(o *observableOptions) {
+		o.tracerProvider = tp
+	}
+}
+
+// WithDuplicateLog 按照 sampleRate 的比例输出重复的 key，sampleRate 是 0 到 1 之间的数，默认不输出
+func WithDuplicateLog(l logger.Logger, sampleRate float64) ObservableOption {
+	return func(o *observableOptions) {
+		o.l = l
+		o.logSampleRate = sampleRate
+	}
+}
+
+func newObservableOptions(opts []ObservableOption) observableOptions {
+	o := observableOptions{
+		registerer:     prometheus.DefaultRegisterer,
+		tracerProvider: otel.GetTracerProvider(),
+		l:              logger.NewNopLogger(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// NewObservableIdempotencyService name 是业务的名字，会作为指标的 service 标签和 span 的属性
+// 返回的服务没有 Begin、Complete 和 Fail，被装饰的服务实现了 StatefulIdempotencyService 的时候
+// 使用 NewObservableStatefulIdempotencyService
+func NewObservableIdempotencyService(svc IdempotencyService, name string, opts ...ObservableOption) *ObservableIdempotencyService {
+	return newObservableIdempotencyService(svc, name, newObservableOptions(opts))
+}
+
+func newObservableIdempotencyService(svc IdempotencyService, name string, o observableOptions) *ObservableIdempotencyService {
+	checked := register(o.registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "idempotency_checked_total",
+		Help: "Total number of keys checked by IdempotencyService",
+	}, []string{"service"}))
+	duplicate := register(o.registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "idempotency_duplicate_total",
+		Help: "Total number of duplicate keys found by IdempotencyService",
+	}, []string{"service"}))
+	duration := register(o.registerer, prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Name: "idempotency_duration_seconds",
+		Help: "IdempotencyService call time in seconds",
+	}, []string{"service", "method", "status"}))
+	return &ObservableIdempotencyService{
+		svc:           svc,
+		name:          name,
+		checked:       checked.WithLabelValues(name),
+		duplicate:     duplicate.WithLabelValues(name),
+		duration:      duration,
+		tracer:        o.tracerProvider.Tracer(instrumentationName),
+		l:             o.l,
+		logSampleRate: o.logSampleRate,
+	}
+}
+
+// register 已经注册过的时候复用已有的指标
+func register[T prometheus.Collector](registerer prometheus.Registerer, c T) T {
+	err := registerer.Register(c)
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(T); ok {
+			return existing
+		}
+	}
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func (s *ObservableIdempotencyService) Exists(ctx context.Context, key string) (bool, error) {
+	res, err := s.check(ctx, "Exists", []string{key}, func(ctx context.Context) ([]bool, error) {
+		exists, err := s.svc.Exists(ctx, key)
+		return []bool{exists}, err
+	})
+	if err != nil {
+		return false, err
+	}
+	return res[0], nil
+}
+
+func (s *ObservableIdempotencyService) MExists(ctx context.Context, keys ...string) ([]bool, error) {
+	return s.check(ctx, "MExists", keys, func(ctx context.Context) ([]bool, error) {
+		return s.svc.MExists(ctx, keys...)
+	})
+}
+
+// Peek 被装饰的服务没有实现 ManageableIdempotencyService 的时候返回 ErrUnsupported，下面的 Release 和 Forget 也是一样
+func (s *ObservableIdempotencyService) Peek(ctx context.Context, key string) (bool, error) {
+	svc, ok := s.svc.(ManageableIdempotencyService)
+	if !ok {
+		return false, ErrUnsupported
+	}
+	var exists bool
+	err := s.observe(ctx, "Peek", func(ctx context.Context) error {
+		var err error
+		exists, err = svc.Peek(ctx, key)
+		return err
+	})
+	return exists, err
+}
+
+func (s *ObservableIdempotencyService) Release(ctx context.Context, key string) error {
+	svc, ok := s.svc.(ManageableIdempotencyService)
+	if !ok {
+		return ErrUnsupported
+	}
+	return s.observe(ctx, "Release", func(ctx context.Context) error {
+		return svc.Release(ctx, key)
+	})
+}
+
+func (s *ObservableIdempotencyService) Forget(ctx context.Context, keys ...string) error {
+	svc, ok := s.svc.(ManageableIdempotencyService)
+	if !ok {
+		return ErrUnsupported
+	}
+	return s.observe(ctx, "Forget", func(ctx context.Context) error {
+		return svc.Forget(ctx, keys...)
+	})
+}
+
+// ObservableStatefulIdempotencyService 在 ObservableIdempotencyService 的基础上加上 Begin、Complete 和 Fail 的监控
+// httpx.Middleware 之类的地方通过类型断言选择两阶段的语义，
+// 装饰 RedisIdempotencyService 这种两个接口都实现了的服务时需要用它，否则会退化成只使用 Exists
+type ObservableStatefulIdempotencyService struct {
+	*ObservableIdempotencyService
+	stateful StatefulIdempotencyService
+	begun    *prometheus.CounterVec
+}
+
+// NewObservableStatefulIdempotencyService 参数的含义和 NewObservableIdempotencyService 一致
+func NewObservableStatefulIdempotencyService(svc interface {
+	IdempotencyService
+	StatefulIdempotencyService
+}, name string, opts ...ObservableOption) *ObservableStatefulIdempotencyService {
+	o := newObservableOptions(opts)
+	begun := register(o.registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "idempotency_begin_total",
+		Help: "Total number of Begin calls grouped by the state of the key",
+	}, []string{"service", "state"}))
+	return &ObservableStatefulIdempotencyService{
+		ObservableIdempotencyService: newObservableIdempotencyService(svc, name, o),
+		stateful:                     svc,
+		begun:                        begun,
+	}
+}
+
+// Begin 没有拿到执行权的 key 也会被算作重复的 key
+func (s *ObservableStatefulIdempotencyService) Begin(ctx context.Context, key string, opts ...BeginOption) (Record, error) {
+	var record Record
+	err := s.observe(ctx, "Begin", func(ctx context.Context) error {
+		var err error
+		record, err = s.stateful.Begin(ctx, key, opts...)
+		if err != nil {
+			return err
+		}
+		s.begun.WithLabelValues(s.name, record.State.String()).Inc()
+		s.checked.Inc()
+		duplicate := !record.State.Acquired()
+		if duplicate {
+			s.duplicate.Inc()
+			if s.logSampleRate > 0 && rand.Float64() < s.logSampleRate {
+				s.l.Info("重复的幂等键", logger.String("service", s.name), logger.String("key", key),
+					logger.String("state", record.State.String()))
+			}
+		}
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String("idempotency.state", record.State.String()),
+			attribute.Bool("idempotency.duplicate", duplicate),
+		)
+		return nil
+	})
+	return record, err
+}
+
+func (s *ObservableStatefulIdempotencyService) Complete(ctx context.Context, key string, token string, result []byte) error {
+	return s.observe(ctx, "Complete", func(ctx context.Context) error {
+		return s.stateful.Complete(ctx, key, token, result)
+	})
+}
+
+func (s *ObservableStatefulIdempotencyService) Fail(ctx context.Context, key string, token string) error {
+	return s.observe(ctx, "Fail", func(ctx context.Context) error {
+		return s.stateful.Fail(ctx, key, token)
+	})
+}
+
+// check 在 observe 的基础上统计检查和重复的 key
+func (s *ObservableIdempotencyService) check(ctx context.Context, method string, keys []string,
+	fn func(ctx context.Context) ([]bool, error)) ([]bool, error) {
+	var res []bool
+	err := s.observe(ctx, method, func(ctx context.Context) error {
+		var err error
+		res, err = fn(ctx)
+		if err != nil {
+			return err
+		}
+		duplicates := 0
+		for i, exists := range res {
+			if !exists {
+				continue
+			}
+			duplicates++
+			if s.logSampleRate > 0 && rand.Float64() < s.logSampleRate {
+				s.l.Info("重复的幂等键", logger.String("service", s.name), logger.String("key", keys[i]))
+			}
+		}
+		s.checked.Add(float64(len(res)))
+		s.duplicate.Add(float64(duplicates))
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(
+			attribute.Int("idempotency.keys", len(res)),
+			attribute.Int("idempotency.duplicates", duplicates),
+			attribute.Bool("idempotency.duplicate", duplicates > 0),
+		)
+		return nil
+	})
+	return res, err
+}
+
+// observe 记录耗时并创建 span
+func (s *ObservableIdempotencyService) observe(ctx context.Context, method string, fn func(ctx context.Context) error) error {
+	ctx, span := s.tracer.Start(ctx, "idempotency."+method, trace.WithAttributes(
+		attribute.String("idempotency.service", s.name),
+	))
+	defer span.End()
+	start := time.Now()
+	err := fn(ctx)
+	status := "success"
+	if err != nil {
+		status = "error"
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	s.duration.WithLabelValues(s.name, method, status).Observe(time.Since(start).Seconds())
+	return err
+}
@@ -0,0 +1,178 @@
+package idempotent
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"github.com/rermrf/emo/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestObservableImplementation(t *testing.T) {
+	IdempotencyServiceTest{
+		Name: "ObservableIdempotencyService",
+		NewService: func() (IdempotencyService, func(), error) {
+			svc := NewObservableIdempotencyService(NewMemoryIdempotencyService(time.Minute, 0), "test",
+				WithRegisterer(prometheus.NewRegistry()))
+			return svc, func() {}, nil
+		},
+	}.RunTests(t)
+}
+
+func TestObservableIdempotencyService(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	tp := &recordingTracerProvider{}
+	l := &recordingLogger{}
+	svc := NewObservableIdempotencyService(NewMemoryIdempotencyService(time.Minute, 0), "order",
+		WithRegisterer(registry), WithTracerProvider(tp), WithDuplicateLog(l, 1))
+	// 同一个 registry 上的第二个实例复用已经注册的指标
+	other := NewObservableIdempotencyService(NewMemoryIdempotencyService(time.Minute, 0), "payment",
+		WithRegisterer(registry))
+	ctx := t.Context()
+
+	_, err := svc.MExists(ctx, "a", "b")
+	require.NoError(t, err)
+	exists, err := svc.Exists(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	_, err = other.Exists(ctx, "a")
+	require.NoError(t, err)
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(svc.checked))
+	assert.Equal(t, 1.0, testutil.ToFloat64(svc.duplicate))
+	assert.Equal(t, 1.0, testutil.ToFloat64(other.checked))
+	assert.Equal(t, 0.0, testutil.ToFloat64(other.duplicate))
+
+	require.Len(t, tp.spans, 2)
+	assert.Equal(t, "idempotency.MExists", tp.spans[0].name)
+	assert.Contains(t, tp.spans[0].attrs, attribute.Bool("idempotency.duplicate", false))
+	assert.Equal(t, "idempotency.Exists", tp.spans[1].name)
+	assert.Contains(t, tp.spans[1].attrs, attribute.Bool("idempotency.duplicate", true))
+	assert.Contains(t, tp.spans[1].attrs, attribute.String("idempotency.service", "order"))
+
+	assert.Equal(t, []string{"a"}, l.keys)
+}
+
+func TestObservableStatefulImplementation(t *testing.T) {
+	StatefulIdempotencyServiceTest{
+		Name: "ObservableStatefulIdempotencyService",
+		NewService: func(t *testing.T, lease time.Duration) (StatefulIdempotencyService, func(d time.Duration)) {
+			mr := miniredis.RunT(t)
+			client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			svc := NewRedisIdempotencyService(client, 10*time.Minute, WithLease(lease))
+			return NewObservableStatefulIdempotencyService(svc, "test", WithRegisterer(prometheus.NewRegistry())), mr.FastForward
+		},
+	}.RunTests(t)
+}
+
+func TestObservableStatefulIdempotencyService(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	tp := &recordingTracerProvider{}
+	svc := NewObservableStatefulIdempotencyService(NewRedisIdempotencyService(client, time.Minute), "order",
+		WithRegisterer(prometheus.NewRegistry()), WithTracerProvider(tp))
+	ctx := t.Context()
+
+	record, err := svc.Begin(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, StateNew, record.State)
+	record2, err := svc.Begin(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, StateInProgress, record2.State)
+	require.NoError(t, svc.Complete(ctx, "a", record.Token, nil))
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(svc.begun.WithLabelValues("order", "new")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(svc.begun.WithLabelValues("order", "in_progress")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(svc.checked))
+	assert.Equal(t, 1.0, testutil.ToFloat64(svc.duplicate))
+
+	require.Len(t, tp.spans, 3)
+	assert.Equal(t, "idempotency.Begin", tp.spans[0].name)
+	assert.Contains(t, tp.spans[0].attrs, attribute.String("idempotency.state", "new"))
+	assert.Contains(t, tp.spans[1].attrs, attribute.Bool("idempotency.duplicate", true))
+	assert.Equal(t, "idempotency.Complete", tp.spans[2].name)
+}
+
+func TestObservableIdempotencyService_Error(t *testing.T) {
+	tp := &recordingTracerProvider{}
+	svc := NewObservableIdempotencyService(alwaysFail{}, "order",
+		WithRegisterer(prometheus.NewRegistry()), WithTracerProvider(tp))
+	_, err := svc.Exists(t.Context(), "a")
+	assert.ErrorIs(t, err, errFail)
+	assert.Equal(t, 0.0, testutil.ToFloat64(svc.checked))
+	require.Len(t, tp.spans, 1)
+	assert.Equal(t, []error{errFail}, tp.spans[0].errs)
+}
+
+var errFail = errors.New("mock error")
+
+type alwaysFail struct {
+	IdempotencyService
+}
+
+func (alwaysFail) Exists(ctx context.Context, key string) (bool, error) {
+	return false, errFail
+}
+
+type recordingTracerProvider struct {
+	noop.TracerProvider
+	mu    sync.Mutex
+	spans []*recordingSpan
+}
+
+func (p *recordingTracerProvider) Tracer(name string, opts ...trace.TracerOption) trace.Tracer {
+	return recordingTracer{p: p}
+}
+
+type recordingTracer struct {
+	noop.Tracer
+	p *recordingTracerProvider
+}
+
+func (r recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	cfg := trace.NewSpanStartConfig(opts...)
+	span := &recordingSpan{name: name, attrs: cfg.Attributes()}
+	r.p.mu.Lock()
+	r.p.spans = append(r.p.spans, span)
+	r.p.mu.Unlock()
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+type recordingSpan struct {
+	noop.Span
+	name  string
+	attrs []attribute.KeyValue
+	errs  []error
+}
+
+func (s *recordingSpan) SetAttributes(kv ...attribute.KeyValue) {
+	s.attrs = append(s.attrs, kv...)
+}
+
+func (s *recordingSpan) RecordError(err error, opts ...trace.EventOption) {
+	s.errs = append(s.errs, err)
+}
+
+type recordingLogger struct {
+	logger.NopLogger
+	keys []string
+}
+
+func (l *recordingLogger) Info(msg string, args ...logger.Field) {
+	for _, arg := range args {
+		if arg.Key == "key" {
+			l.keys = append(l.keys, arg.Value.(string))
+		}
+	}
+}
@@ -0,0 +1,16 @@
+-- 只检查不添加，返回 1 表示现在调用 Exists 或者 Begin 不会拿到执行权
+local key = KEYS[1]
+
+local typ = redis.call('TYPE', key)['ok']
+if typ == 'none' then
+    return 0
+end
+if typ ~= 'hash' then
+    -- Exists 写入的 key
+    return 1
+end
+-- 处理中和处理成功的都算存在，处理失败的下一次 Begin 可以重新拿到执行权
+if redis.call('HGET', key, 'state') == 'failed' then
+    return 0
+end
+return 1
@@ -2,27 +2,120 @@ package idempotent
 
 import (
 	"context"
+	"crypto/rand"
+	_ "embed"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/rermrf/emo/slice"
+)
+
+//go:embed begin.lua
+var luaBegin string
+
+//go:embed complete.lua
+var luaComplete string
+
+//go:embed fail.lua
+var luaFail string
+
+//go:embed mexists.lua
+var luaMExists string
+
+//go:embed peek.lua
+var luaPeek string
+
+var (
+	beginScript    = redis.NewScript(luaBegin)
+	completeScript = redis.NewScript(luaComplete)
+	failScript     = redis.NewScript(luaFail)
+	mexistsScript  = redis.NewScript(luaMExists)
+	peekScript     = redis.NewScript(luaPeek)
+)
+
+var (
+	_ ManageableIdempotencyService = (*RedisIdempotencyService)(nil)
+	_ StatefulIdempotencyService   = (*RedisIdempotencyService)(nil)
 )
 
 type RedisIdempotencyService struct {
 	client redis.Cmdable
 	expiry time.Duration
+	// Begin 拿到的执行权的租期
+	lease time.Duration
+	// 处理成功的记录和结果的保存时间
+	resultTTL time.Duration
+	// 处理结果的大小上限，单位字节，小于等于 0 表示不限制
+	maxResultSize int
+	// key 的前缀，不同的业务共用一个 Redis 的时候用来隔离
+	namespace string
+	// 为 nil 的时候直接使用调用者的 key
+	hasher KeyHasher
+}
+
+// RedisOption RedisIdempotencyService 的配置项
+type RedisOption func(s *RedisIdempotencyService)
+
+// WithLease 设置 Begin 拿到的执行权的租期，默认是 30 秒
+// 租期要大于业务的最长执行时间，否则业务还没执行完，重复的请求就会拿到执行权
+func WithLease(lease time.Duration) RedisOption {
+	return func(s *RedisIdempotencyService) {
+		s.lease = lease
+	}
+}
+
+// WithResultTTL 设置处理成功的记录和结果的保存时间，默认和 expiry 一致，小于等于 0 表示不过期
+func WithResultTTL(ttl time.Duration) RedisOption {
+	return func(s *RedisIdempotencyService) {
+		s.resultTTL = ttl
+	}
+}
+
+// WithMaxResultSize 设置处理结果的大小上限，默认是 64KB，小于等于 0 表示不限制
+func WithMaxResultSize(size int) RedisOption {
+	return func(s *RedisIdempotencyService) {
+		s.maxResultSize = size
+	}
+}
+
+// WithNamespace 设置 key 的前缀，默认是 idempotency，最终的 key 是 namespace:key
+func WithNamespace(namespace string) RedisOption {
+	return func(s *RedisIdempotencyService) {
+		s.namespace = strings.TrimSuffix(namespace, ":")
+	}
+}
+
+// WithKeyHasher 保存之前先对 key 做哈希，例如 SHA256KeyHasher 或者 XXHashKeyHasher
+// 修改之后已经保存的 key 全部失效
+func WithKeyHasher(hasher KeyHasher) RedisOption {
+	return func(s *RedisIdempotencyService) {
+		s.hasher = hasher
+	}
 }
 
 // NewRedisIdempotencyService 创建一个新的Redis幂等性服务
-func NewRedisIdempotencyService(client redis.Cmdable, expiry time.Duration) *RedisIdempotencyService {
-	return &RedisIdempotencyService{
-		client: client,
-		expiry: expiry,
+func NewRedisIdempotencyService(client redis.Cmdable, expiry time.Duration, opts ...RedisOption) *RedisIdempotencyService {
+	s := &RedisIdempotencyService{
+		client:        client,
+		expiry:        expiry,
+		lease:         30 * time.Second,
+		resultTTL:     expiry,
+		maxResultSize: 64 << 10,
+		namespace:     "idempotency",
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 func (r *RedisIdempotencyService) getKey(key string) string {
-	return fmt.Sprintf("idempotency:%s", key)
+	if r.hasher != nil {
+		key = r.hasher(key)
+	}
+	return r.namespace + ":" + key
 }
 
 func (r *RedisIdempotencyService) Exists(ctx context.Context, key string) (bool, error) {
@@ -33,26 +126,172 @@ func (r *RedisIdempotencyService) Exists(ctx context.Context, key string) (bool,
 	return !result, nil
 }
 
+// MExists 有 key 检查失败的时候返回 *MExistsError，可以通过 errors.As 拿到每个 key 的结果
 func (r *RedisIdempotencyService) MExists(ctx context.Context, keys ...string) ([]bool, error) {
-	// 使用管道批量执行SetNX命令
-	pipe := r.client.Pipeline()
-	cmds := make([]*redis.BoolCmd, len(keys))
+	results := r.MExistsResults(ctx, keys...)
+	exists := make([]bool, len(results))
+	for i, res := range results {
+		if res.Err != nil {
+			return nil, &MExistsError{Results: results}
+		}
+		exists[i] = res.Exists
+	}
+	return exists, nil
+}
 
+// MExistsResults 返回每个 key 的结果
+// 同一个 slot 的 key 在一个 lua 脚本里面检查并添加，每个 slot 一个脚本，所有脚本在一个管道里面发送。
+// 不管 client 是不是 *redis.ClusterClient 都按照 slot 分组，包装过的 ClusterClient 也不会出现 CROSSSLOT 错误
+// redis.Ring 按照整个 key 而不是 slot 分片，使用 Ring 的时候批量的 key 需要带上相同的 hash tag
+func (r *RedisIdempotencyService) MExistsResults(ctx context.Context, keys ...string) []KeyResult {
+	results := make([]KeyResult, len(keys))
+	if len(keys) == 0 {
+		return results
+	}
+	redisKeys := make([]string, len(keys))
 	for i, key := range keys {
-		cmds[i] = pipe.SetNX(ctx, r.getKey(key), "1", r.expiry)
+		results[i].Key = key
+		redisKeys[i] = r.getKey(key)
+	}
+	groups := groupBySlot(redisKeys)
+
+	cmds := r.mexists(ctx, redisKeys, groups, false)
+	// 脚本还没有被加载到节点上，需要重新发送脚本内容
+	retry := make([][]int, 0)
+	retryIdx := make([]int, 0)
+	for i, cmd := range cmds {
+		if redis.HasErrorPrefix(cmd.Err(), "NOSCRIPT") {
+			retry = append(retry, groups[i])
+			retryIdx = append(retryIdx, i)
+		}
+	}
+	if len(retry) > 0 {
+		for i, cmd := range r.mexists(ctx, redisKeys, retry, true) {
+			cmds[retryIdx[i]] = cmd
+		}
+	}
+
+	for i, cmd := range cmds {
+		vals, err := cmd.Int64Slice()
+		if err == nil && len(vals) != len(groups[i]) {
+			err = fmt.Errorf("idempotent: 脚本返回了 %d 个结果，预期是 %d 个", len(vals), len(groups[i]))
+		}
+		for j, idx := range groups[i] {
+			if err != nil {
+				results[idx].Err = err
+				continue
+			}
+			results[idx].Exists = vals[j] == 1
+		}
 	}
+	return results
+}
+
+// mexists 在一个管道里面为每一组 key 执行一次脚本，每个脚本的错误记录在各自的 cmd 上
+func (r *RedisIdempotencyService) mexists(ctx context.Context, keys []string, groups [][]int, eval bool) []*redis.Cmd {
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.Cmd, len(groups))
+	for i, group := range groups {
+		groupKeys := slice.Map(group, func(_ int, idx int) string {
+			return keys[idx]
+		})
+		if eval {
+			cmds[i] = mexistsScript.Eval(ctx, pipe, groupKeys, expiryMillis(r.expiry))
+		} else {
+			cmds[i] = mexistsScript.EvalSha(ctx, pipe, groupKeys, expiryMillis(r.expiry))
+		}
+	}
+	_, _ = pipe.Exec(ctx)
+	return cmds
+}
+
+// expiryMillis 传给脚本的过期时间，小于等于 0 表示不过期，不足 1 毫秒的按照 1 毫秒处理
+func expiryMillis(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return max(d.Milliseconds(), 1)
+}
+
+// Peek 按照 key 的状态返回：
+//   - 通过 Exists 或者 MExists 写入的：true
+//   - Begin 之后处理中、租期还没有过的：true
+//   - Complete 之后处理成功的：true
+//   - Fail 之后处理失败的：false，下一次 Begin 会拿到执行权
+//   - 不存在或者已经过期的：false
+func (r *RedisIdempotencyService) Peek(ctx context.Context, key string) (bool, error) {
+	res, err := peekScript.Run(ctx, r.client, []string{r.getKey(key)}).Int()
+	return res == 1, err
+}
+
+func (r *RedisIdempotencyService) Release(ctx context.Context, key string) error {
+	return r.client.Del(ctx, r.getKey(key)).Err()
+}
 
+// Forget 逐个删除，避免在集群模式下出现 CROSSSLOT 错误
+func (r *RedisIdempotencyService) Forget(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	pipe := r.client.Pipeline()
+	for _, key := range keys {
+		pipe.Del(ctx, r.getKey(key))
+	}
 	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r *RedisIdempotencyService) Begin(ctx context.Context, key string, opts ...BeginOption) (Record, error) {
+	o := newBeginOptions(opts)
+	token := rand.Text()
+	res, err := beginScript.Run(ctx, r.client, []string{r.getKey(key)}, r.lease.Milliseconds(), o.fingerprint, token).StringSlice()
 	if err != nil {
-		return nil, err
+		return Record{}, err
 	}
-	results := make([]bool, len(keys))
-	for i, cmd := range cmds {
-		exists, err := cmd.Result()
-		if err != nil {
-			return nil, err
+	switch res[0] {
+	case "new":
+		return Record{State: StateNew, Token: token}, nil
+	case "failed":
+		return Record{State: StateFailed, Token: token}, nil
+	case "in_progress":
+		return Record{State: StateInProgress}, nil
+	case "mismatch":
+		return Record{}, ErrFingerprintMismatch
+	default:
+		record := Record{State: StateCompleted}
+		if len(res) > 1 {
+			record.Result = []byte(res[1])
 		}
-		results[i] = !exists
+		return record, nil
+	}
+}
+
+func (r *RedisIdempotencyService) Complete(ctx context.Context, key string, token string, result []byte) error {
+	if r.maxResultSize > 0 && len(result) > r.maxResultSize {
+		return ErrResultTooLarge
+	}
+	hasResult := "0"
+	if result != nil {
+		hasResult = "1"
+	}
+	ok, err := completeScript.Run(ctx, r.client, []string{r.getKey(key)},
+		expiryMillis(r.resultTTL), token, hasResult, result).Bool()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (r *RedisIdempotencyService) Fail(ctx context.Context, key string, token string) error {
+	ok, err := failScript.Run(ctx, r.client, []string{r.getKey(key)}, expiryMillis(r.expiry), token).Bool()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrLeaseLost
 	}
-	return results, nil
+	return nil
 }
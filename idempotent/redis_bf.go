@@ -2,36 +2,105 @@ package idempotent
 
 import (
 	"context"
-	"errors"
+	"math"
+	"sync/atomic"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/rermrf/emo/logger"
 	"github.com/rermrf/emo/slice"
 )
 
+var _ ManageableIdempotencyService = (*BloomIdempotencyService)(nil)
+
 type BloomIdempotencyService struct {
 	client     redis.Cmdable
 	filterName string
 	capacity   uint64  // 预期容量
 	errorRate  float64 // 误判率
+	// 容量用完之后新的子过滤器的容量倍数，0 表示使用 RedisBloom 的默认值 2
+	expansion int64
+	// 容量用完之后不再扩容，BF.ADD 会直接报错
+	nonScaling bool
+
+	l logger.Logger
+	// 插入的元素达到 capacity 的这个比例之后开始告警
+	warnRatio float64
+	// 每插入多少个元素检查一次容量
+	checkInterval uint64
+	added         atomic.Uint64
+
+	// 布隆过滤器已经创建过了
+	reserved atomic.Bool
+}
+
+// BloomOption BloomIdempotencyService 的配置项
+type BloomOption func(s *BloomIdempotencyService)
+
+// WithExpansion 设置容量用完之后新的子过滤器的容量倍数
+func WithExpansion(expansion int64) BloomOption {
+	return func(s *BloomIdempotencyService) {
+		s.expansion = expansion
+	}
 }
 
-func NewBloomIdempotencyService(client redis.Cmdable, filterName string, capacity uint64, errorRate float64) *BloomIdempotencyService {
-	return &BloomIdempotencyService{
-		client:     client,
-		filterName: filterName,
-		capacity:   capacity,
-		errorRate:  errorRate,
+// WithNonScaling 容量用完之后不再扩容，误判率不会继续上升，但是后续的写入会报错
+func WithNonScaling() BloomOption {
+	return func(s *BloomIdempotencyService) {
+		s.nonScaling = true
+	}
+}
+
+// WithCapacityWarning 插入的元素达到 capacity 的 ratio 倍之后，通过 l 输出告警
+// 每插入 checkInterval 个元素检查一次，默认是 0.9 倍、每 1000 个元素检查一次
+func WithCapacityWarning(l logger.Logger, ratio float64, checkInterval uint64) BloomOption {
+	return func(s *BloomIdempotencyService) {
+		s.l = l
+		s.warnRatio = ratio
+		s.checkInterval = checkInterval
+	}
+}
+
+// NewBloomIdempotencyService capacity 为 0 或者 errorRate 不在 (0, 1) 之间的时候会 panic
+func NewBloomIdempotencyService(client redis.Cmdable, filterName string, capacity uint64, errorRate float64, opts ...BloomOption) *BloomIdempotencyService {
+	if err := validateBloomConfig(capacity, errorRate); err != nil {
+		panic(err)
+	}
+	s := &BloomIdempotencyService{
+		client:        client,
+		filterName:    filterName,
+		capacity:      capacity,
+		errorRate:     errorRate,
+		l:             logger.NewNopLogger(),
+		warnRatio:     0.9,
+		checkInterval: 1000,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 func (s *BloomIdempotencyService) Exists(ctx context.Context, key string) (bool, error) {
+	if err := s.reserve(ctx); err != nil {
+		return false, err
+	}
 	res, err := s.client.BFAdd(ctx, s.filterName, key).Result()
-	return !res, err
+	if err != nil {
+		return false, err
+	}
+	if res {
+		s.onAdded(ctx, 1)
+	}
+	return !res, nil
 }
 
 func (s *BloomIdempotencyService) MExists(ctx context.Context, keys ...string) ([]bool, error) {
+	// BF.MADD 至少需要一个元素，空的输入和其它实现一样返回空的结果
 	if len(keys) == 0 {
-		return nil, errors.New("empty keys")
+		return []bool{}, nil
+	}
+	if err := s.reserve(ctx); err != nil {
+		return nil, err
 	}
 	// 执行批量查询
 	res := s.client.BFMAdd(ctx, s.filterName, slice.Map(keys, func(_ int, src string) any {
@@ -41,7 +110,158 @@ func (s *BloomIdempotencyService) MExists(ctx context.Context, keys ...string) (
 	if err != nil {
 		return nil, err
 	}
-	return slice.Map(val, func(_ int, src bool) bool {
+	added := 0
+	exists := slice.Map(val, func(_ int, src bool) bool {
+		if src {
+			added++
+		}
 		return !src
-	}), nil
+	})
+	s.onAdded(ctx, added)
+	return exists, nil
+}
+
+func (s *BloomIdempotencyService) Peek(ctx context.Context, key string) (bool, error) {
+	if err := s.reserve(ctx); err != nil {
+		return false, err
+	}
+	return s.client.BFExists(ctx, s.filterName, key).Result()
+}
+
+// Release 布隆过滤器不支持删除，返回 ErrUnsupported
+func (s *BloomIdempotencyService) Release(ctx context.Context, key string) error {
+	return ErrUnsupported
+}
+
+// Forget 布隆过滤器不支持删除，返回 ErrUnsupported
+func (s *BloomIdempotencyService) Forget(ctx context.Context, keys ...string) error {
+	return ErrUnsupported
+}
+
+// BloomInfo 布隆过滤器的使用情况
+type BloomInfo struct {
+	// 所有子过滤器的总容量
+	Capacity int64
+	// 占用的内存，单位字节
+	Size int64
+	// 子过滤器的个数，大于 1 说明已经扩容过
+	Filters int64
+	// 已经插入的元素个数
+	ItemsInserted int64
+	// 已经插入的元素占预期容量的比例
+	FillRatio float64
+	// 根据已经插入的元素估算的误判率
+	EstimatedFalsePositiveRate float64
+}
+
+// Info 查询布隆过滤器的使用情况
+func (s *BloomIdempotencyService) Info(ctx context.Context) (BloomInfo, error) {
+	if err := s.reserve(ctx); err != nil {
+		return BloomInfo{}, err
+	}
+	info, err := s.client.BFInfo(ctx, s.filterName).Result()
+	if err != nil {
+		return BloomInfo{}, err
+	}
+	return BloomInfo{
+		Capacity:                   info.Capacity,
+		Size:                       info.Size,
+		Filters:                    info.Filters,
+		ItemsInserted:              info.ItemsInserted,
+		FillRatio:                  float64(info.ItemsInserted) / float64(s.capacity),
+		EstimatedFalsePositiveRate: estimateFalsePositiveRate(s.capacity, s.errorRate, s.expansion, s.nonScaling, uint64(info.ItemsInserted)),
+	}, nil
+}
+
+// reserve 第一次使用时按照 capacity 和 errorRate 创建布隆过滤器
+// 不提前创建的话 BF.ADD 会使用 RedisBloom 的默认参数创建
+// 并发调用时可能会重复尝试创建，创建失败的时候只要过滤器已经存在就算成功
+func (s *BloomIdempotencyService) reserve(ctx context.Context) error {
+	if s.reserved.Load() {
+		return nil
+	}
+	// 其它实例已经创建过了
+	exists, err := s.exists(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		err = s.client.BFReserveWithArgs(ctx, s.filterName, &redis.BFReserveOptions{
+			Capacity:   int64(s.capacity),
+			Error:      s.errorRate,
+			Expansion:  s.expansion,
+			NonScaling: s.nonScaling,
+		}).Err()
+		if err != nil {
+			// 和其它实例同时创建的时候会失败
+			if exists, existsErr := s.exists(ctx); existsErr != nil || !exists {
+				return err
+			}
+		}
+	}
+	s.reserved.Store(true)
+	return nil
+}
+
+func (s *BloomIdempotencyService) exists(ctx context.Context) (bool, error) {
+	cnt, err := s.client.Exists(ctx, s.filterName).Result()
+	return cnt > 0, err
+}
+
+// onAdded 每插入 checkInterval 个元素检查一次容量
+func (s *BloomIdempotencyService) onAdded(ctx context.Context, n int) {
+	if n == 0 || s.checkInterval == 0 {
+		return
+	}
+	total := s.added.Add(uint64(n))
+	if total/s.checkInterval == (total-uint64(n))/s.checkInterval {
+		return
+	}
+	info, err := s.Info(ctx)
+	if err != nil {
+		s.l.Warn("查询布隆过滤器容量失败", logger.Error(err), logger.String("filter", s.filterName))
+		return
+	}
+	if info.FillRatio >= s.warnRatio {
+		s.l.Warn("布隆过滤器容量即将用完",
+			logger.String("filter", s.filterName),
+			logger.Int64("items", info.ItemsInserted),
+			logger.Any("capacity", s.capacity),
+			logger.Any("fillRatio", info.FillRatio),
+			logger.Any("estimatedFalsePositiveRate", info.EstimatedFalsePositiveRate))
+	}
+}
+
+// estimateFalsePositiveRate 估算插入 items 个元素之后的误判率
+// RedisBloom 扩容时新的子过滤器容量是上一个的 expansion 倍，误判率是上一个的一半，
+// 查询时任何一个子过滤器误判都会误判
+func estimateFalsePositiveRate(capacity uint64, errorRate float64, expansion int64, nonScaling bool, items uint64) float64 {
+	if capacity == 0 || items == 0 {
+		return 0
+	}
+	if expansion <= 0 {
+		expansion = 2
+	}
+	layerCapacity, layerErrorRate := float64(capacity), errorRate
+	remaining := float64(items)
+	noFalsePositive := 1.0
+	for remaining > 0 {
+		n := min(remaining, layerCapacity)
+		if nonScaling {
+			n = remaining
+		}
+		noFalsePositive *= 1 - layerFalsePositiveRate(layerCapacity, layerErrorRate, n)
+		remaining -= n
+		layerCapacity *= float64(expansion)
+		layerErrorRate /= 2
+	}
+	return 1 - noFalsePositive
+}
+
+// layerFalsePositiveRate 按照 capacity 和 errorRate 创建的过滤器在插入 n 个元素之后的误判率
+func layerFalsePositiveRate(capacity, errorRate, n float64) float64 {
+	// 位数组大小和哈希函数个数的计算方式和 RedisBloom 一致
+	bits := -capacity * math.Log(errorRate) / (math.Ln2 * math.Ln2)
+	hashes := math.Ceil(math.Ln2 * bits / capacity)
+	return math.Pow(1-math.Exp(-hashes*n/bits), hashes)
 }
@@ -0,0 +1,187 @@
+package idempotent
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rermrf/emo/slice"
+)
+
+var _ ManageableIdempotencyService = (*RotatingBloomIdempotencyService)(nil)
+
+// RotatingBloomIdempotencyService 按照时间轮换的布隆过滤器
+// 每个 period 使用一个新的布隆过滤器（一代），同时保留最近 generations 代，
+// 查询时检查所有存活的代，写入时只写入当前代，最老的一代过期之后直接删除，
+// 所以一个 key 大约会被记住 (generations-1)*period 到 generations*period 的时间，
+// 类似于 RedisIdempotencyService 的 expiry
+type RotatingBloomIdempotencyService struct {
+	client      redis.Cmdable
+	filterName  string
+	capacity    uint64
+	errorRate   float64
+	period      time.Duration
+	generations int64
+	opts        []BloomOption
+	now         func() time.Time
+
+	mu sync.Mutex
+	// 已经创建过的代
+	filters map[int64]*BloomIdempotencyService
+}
+
+// NewRotatingBloomIdempotencyService 创建一个按照时间轮换的布隆过滤器
+// capacity 和 errorRate 是每一代的预期容量和误判率，generations 至少是 1
+// capacity 为 0、errorRate 不在 (0, 1) 之间或者 period 小于 1 毫秒的时候会 panic
+func NewRotatingBloomIdempotencyService(client redis.Cmdable, filterName string, capacity uint64, errorRate float64,
+	period time.Duration, generations int, opts ...BloomOption) *RotatingBloomIdempotencyService {
+	if period < time.Millisecond {
+		panic("idempotent: 布隆过滤器的轮换周期不能小于 1 毫秒")
+	}
+	if err := validateBloomConfig(capacity, errorRate); err != nil {
+		panic(err)
+	}
+	return &RotatingBloomIdempotencyService{
+		client:      client,
+		filterName:  filterName,
+		capacity:    capacity,
+		errorRate:   errorRate,
+		period:      period,
+		generations: int64(max(generations, 1)),
+		opts:        opts,
+		now:         time.Now,
+		filters:     make(map[int64]*BloomIdempotencyService),
+	}
+}
+
+func (s *RotatingBloomIdempotencyService) Exists(ctx context.Context, key string) (bool, error) {
+	res, err := s.MExists(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	return res[0], nil
+}
+
+func (s *RotatingBloomIdempotencyService) MExists(ctx context.Context, keys ...string) ([]bool, error) {
+	if len(keys) == 0 {
+		return []bool{}, nil
+	}
+	current, previous := s.liveGenerations()
+	// 先检查之前的代
+	results := make([]bool, len(keys))
+	if len(previous) > 0 {
+		pipe := s.client.Pipeline()
+		cmds := make([]*redis.BoolSliceCmd, 0, len(previous))
+		args := slice.Map(keys, func(_ int, src string) any {
+			return src
+		})
+		for _, gen := range previous {
+			cmds = append(cmds, pipe.BFMExists(ctx, s.name(gen), args...))
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+		for _, cmd := range cmds {
+			for i, exists := range cmd.Val() {
+				results[i] = results[i] || exists
+			}
+		}
+	}
+
+	// 之前的代都不存在的 key 写入当前代
+	idx := make([]int, 0, len(keys))
+	for i, exists := range results {
+		if !exists {
+			idx = append(idx, i)
+		}
+	}
+	if len(idx) == 0 {
+		return results, nil
+	}
+	filter, err := s.filter(ctx, current)
+	if err != nil {
+		return nil, err
+	}
+	res, err := filter.MExists(ctx, slice.Map(idx, func(_ int, src int) string {
+		return keys[src]
+	})...)
+	if err != nil {
+		return nil, err
+	}
+	for i, exists := range res {
+		results[idx[i]] = exists
+	}
+	return results, nil
+}
+
+// Peek 检查所有存活的代，包括当前代
+func (s *RotatingBloomIdempotencyService) Peek(ctx context.Context, key string) (bool, error) {
+	current, previous := s.liveGenerations()
+	pipe := s.client.Pipeline()
+	cmds := make([]*redis.BoolCmd, 0, len(previous)+1)
+	for _, gen := range append(previous, current) {
+		cmds = append(cmds, pipe.BFExists(ctx, s.name(gen), key))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	for _, cmd := range cmds {
+		if cmd.Val() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Release 布隆过滤器不支持删除，返回 ErrUnsupported
+func (s *RotatingBloomIdempotencyService) Release(ctx context.Context, key string) error {
+	return ErrUnsupported
+}
+
+// Forget 布隆过滤器不支持删除，返回 ErrUnsupported
+func (s *RotatingBloomIdempotencyService) Forget(ctx context.Context, keys ...string) error {
+	return ErrUnsupported
+}
+
+// liveGenerations 返回当前代和之前还存活的代
+func (s *RotatingBloomIdempotencyService) liveGenerations() (int64, []int64) {
+	current := s.now().UnixMilli() / s.period.Milliseconds()
+	previous := make([]int64, 0, s.generations-1)
+	for gen := current - 1; gen > current-s.generations; gen-- {
+		previous = append(previous, gen)
+	}
+	return current, previous
+}
+
+// filter 获取某一代的布隆过滤器，第一次使用时创建并设置过期时间
+func (s *RotatingBloomIdempotencyService) filter(ctx context.Context, gen int64) (*BloomIdempotencyService, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if filter, ok := s.filters[gen]; ok {
+		return filter, nil
+	}
+	name := s.name(gen)
+	filter := NewBloomIdempotencyService(s.client, name, s.capacity, s.errorRate, s.opts...)
+	if err := filter.reserve(ctx); err != nil {
+		return nil, err
+	}
+	// 这一代在 generations 个周期之后不再被查询
+	expireAt := time.UnixMilli((gen + s.generations) * s.period.Milliseconds())
+	if err := s.client.PExpireAt(ctx, name, expireAt).Err(); err != nil {
+		return nil, err
+	}
+	// 清理已经不再使用的代
+	for g := range s.filters {
+		if g < gen {
+			delete(s.filters, g)
+		}
+	}
+	s.filters[gen] = filter
+	return filter, nil
+}
+
+func (s *RotatingBloomIdempotencyService) name(gen int64) string {
+	return s.filterName + ":" + strconv.FormatInt(gen, 10)
+}
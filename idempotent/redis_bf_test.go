@@ -0,0 +1,350 @@
+package idempotent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBloom 在 hook 里面模拟 RedisBloom 的命令，miniredis 不支持布隆过滤器
+// 用 map 代替布隆过滤器，不会误判，同时记录收到的所有命令
+type fakeBloom struct {
+	mu      sync.Mutex
+	cmds    [][]any
+	filters map[string]map[string]struct{}
+	// 通过 PEXPIREAT 设置的过期时间
+	expireAt map[string]time.Time
+}
+
+func newFakeBloomClient(t *testing.T) (*redis.Client, *fakeBloom) {
+	client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	f := &fakeBloom{
+		filters:  make(map[string]map[string]struct{}),
+		expireAt: make(map[string]time.Time),
+	}
+	client.AddHook(f)
+	return client, f
+}
+
+func (f *fakeBloom) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (f *fakeBloom) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if f.process(cmd) {
+			return cmd.Err()
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (f *fakeBloom) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		remaining := make([]redis.Cmder, 0, len(cmds))
+		var firstErr error
+		for _, cmd := range cmds {
+			if !f.process(cmd) {
+				remaining = append(remaining, cmd)
+				continue
+			}
+			if firstErr == nil {
+				firstErr = cmd.Err()
+			}
+		}
+		if len(remaining) > 0 {
+			if err := next(ctx, remaining); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+}
+
+// process 处理布隆过滤器相关的命令，返回 false 表示交给 miniredis
+func (f *fakeBloom) process(cmd redis.Cmder) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	args := cmd.Args()
+	name := strings.ToLower(cmd.Name())
+	if !strings.HasPrefix(name, "bf.") && name != "exists" && name != "pexpireat" {
+		return false
+	}
+	f.cmds = append(f.cmds, args)
+	key := fmt.Sprint(args[1])
+	filter, ok := f.filters[key]
+	switch name {
+	case "exists":
+		cnt := int64(0)
+		if ok {
+			cnt = 1
+		}
+		cmd.(*redis.IntCmd).SetVal(cnt)
+	case "pexpireat":
+		f.expireAt[key] = time.UnixMilli(args[2].(int64))
+		cmd.(*redis.BoolCmd).SetVal(ok)
+	case "bf.reserve":
+		if ok {
+			cmd.SetErr(errors.New("ERR item exists"))
+			break
+		}
+		f.filters[key] = make(map[string]struct{})
+		cmd.(*redis.StatusCmd).SetVal("OK")
+	case "bf.add", "bf.madd":
+		if !ok {
+			filter = make(map[string]struct{})
+			f.filters[key] = filter
+		}
+		res := make([]bool, 0, len(args)-2)
+		for _, arg := range args[2:] {
+			item := fmt.Sprint(arg)
+			_, exists := filter[item]
+			filter[item] = struct{}{}
+			res = append(res, !exists)
+		}
+		if name == "bf.add" {
+			cmd.(*redis.BoolCmd).SetVal(res[0])
+		} else {
+			cmd.(*redis.BoolSliceCmd).SetVal(res)
+		}
+	case "bf.exists", "bf.mexists":
+		res := make([]bool, 0, len(args)-2)
+		for _, arg := range args[2:] {
+			_, exists := filter[fmt.Sprint(arg)]
+			res = append(res, exists)
+		}
+		if name == "bf.exists" {
+			cmd.(*redis.BoolCmd).SetVal(res[0])
+		} else {
+			cmd.(*redis.BoolSliceCmd).SetVal(res)
+		}
+	default:
+		cmd.SetErr(fmt.Errorf("fakeBloom: 不支持的命令 %s", name))
+	}
+	return true
+}
+
+// commands 返回收到的 name 命令的参数
+func (f *fakeBloom) commands(name string) [][]any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res := make([][]any, 0)
+	for _, args := range f.cmds {
+		if strings.EqualFold(fmt.Sprint(args[0]), name) {
+			res = append(res, args)
+		}
+	}
+	return res
+}
+
+func TestBloomImplementation(t *testing.T) {
+	IdempotencyServiceTest{
+		Name: "BloomIdempotencyService",
+		NewService: func() (IdempotencyService, func(), error) {
+			client, _ := newFakeBloomClient(t)
+			return NewBloomIdempotencyService(client, "filter", 1000, 0.01), func() {}, nil
+		},
+	}.RunTests(t)
+}
+
+func TestBloomIdempotencyService_Reserve(t *testing.T) {
+	testCases := []struct {
+		name string
+		opts []BloomOption
+		want []any
+	}{
+		{
+			name: "默认参数",
+			want: []any{"BF.RESERVE", "filter", 0.01, int64(1000)},
+		},
+		{
+			name: "扩容倍数",
+			opts: []BloomOption{WithExpansion(4)},
+			want: []any{"BF.RESERVE", "filter", 0.01, int64(1000), "EXPANSION", int64(4)},
+		},
+		{
+			name: "不扩容",
+			opts: []BloomOption{WithNonScaling()},
+			want: []any{"BF.RESERVE", "filter", 0.01, int64(1000), "NONSCALING"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, f := newFakeBloomClient(t)
+			s := NewBloomIdempotencyService(client, "filter", 1000, 0.01, tc.opts...)
+			ctx := t.Context()
+			for i := 0; i < 3; i++ {
+				_, err := s.Exists(ctx, "key")
+				require.NoError(t, err)
+			}
+			// 只在第一次使用的时候创建
+			assert.Equal(t, [][]any{tc.want}, f.commands("BF.RESERVE"))
+			assert.Len(t, f.commands("EXISTS"), 1)
+		})
+	}
+}
+
+func TestBloomIdempotencyService_ReserveExisting(t *testing.T) {
+	client, f := newFakeBloomClient(t)
+	ctx := t.Context()
+	// 其它实例已经创建过了
+	require.NoError(t, client.BFReserve(ctx, "filter", 0.01, 1000).Err())
+
+	s := NewBloomIdempotencyService(client, "filter", 1000, 0.01)
+	_, err := s.Exists(ctx, "key")
+	require.NoError(t, err)
+	assert.Len(t, f.commands("BF.RESERVE"), 1)
+}
+
+func TestEstimateFalsePositiveRate(t *testing.T) {
+	testCases := []struct {
+		name       string
+		items      uint64
+		nonScaling bool
+		wantMin    float64
+		wantMax    float64
+	}{
+		{
+			name:    "空过滤器",
+			items:   0,
+			wantMin: 0,
+			wantMax: 0,
+		},
+		{
+			name:    "用了一半",
+			items:   5000,
+			wantMin: 0,
+			wantMax: 0.001,
+		},
+		{
+			name:    "刚好用满",
+			items:   10000,
+			wantMin: 0.005,
+			wantMax: 0.011,
+		},
+		{
+			name:    "扩容之后误判率会继续上升，但是有上限",
+			items:   30000,
+			wantMin: 0.01,
+			wantMax: 0.02,
+		},
+		{
+			name:       "不扩容时超出容量误判率急剧上升",
+			items:      30000,
+			nonScaling: true,
+			wantMin:    0.3,
+			wantMax:    1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rate := estimateFalsePositiveRate(10000, 0.01, 0, tc.nonScaling, tc.items)
+			assert.GreaterOrEqual(t, rate, tc.wantMin)
+			assert.LessOrEqual(t, rate, tc.wantMax)
+		})
+	}
+}
+
+func TestRotatingBloomIdempotencyService_LiveGenerations(t *testing.T) {
+	testCases := []struct {
+		name         string
+		generations  int
+		now          time.Time
+		wantCurrent  int64
+		wantPrevious []int64
+	}{
+		{
+			name:         "只有一代",
+			generations:  1,
+			now:          time.UnixMilli(0).Add(5*time.Hour + time.Minute),
+			wantCurrent:  5,
+			wantPrevious: []int64{},
+		},
+		{
+			name:         "保留三代",
+			generations:  3,
+			now:          time.UnixMilli(0).Add(5*time.Hour + time.Minute),
+			wantCurrent:  5,
+			wantPrevious: []int64{4, 3},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewRotatingBloomIdempotencyService(nil, "filter", 1000, 0.01, time.Hour, tc.generations)
+			s.now = func() time.Time {
+				return tc.now
+			}
+			current, previous := s.liveGenerations()
+			assert.Equal(t, tc.wantCurrent, current)
+			assert.Equal(t, tc.wantPrevious, previous)
+			assert.Equal(t, "filter:5", s.name(current))
+		})
+	}
+}
+
+func TestRotatingBloomIdempotencyService_InvalidPeriod(t *testing.T) {
+	for _, period := range []time.Duration{0, -time.Hour, time.Microsecond} {
+		assert.Panics(t, func() {
+			NewRotatingBloomIdempotencyService(nil, "filter", 1000, 0.01, period, 3)
+		}, period)
+	}
+}
+
+func TestRotatingBloomImplementation(t *testing.T) {
+	IdempotencyServiceTest{
+		Name: "RotatingBloomIdempotencyService",
+		NewService: func() (IdempotencyService, func(), error) {
+			client, _ := newFakeBloomClient(t)
+			return NewRotatingBloomIdempotencyService(client, "filter", 1000, 0.01, time.Hour, 3), func() {}, nil
+		},
+	}.RunTests(t)
+}
+
+func TestRotatingBloomIdempotencyService_Rotate(t *testing.T) {
+	client, f := newFakeBloomClient(t)
+	s := NewRotatingBloomIdempotencyService(client, "filter", 1000, 0.01, time.Hour, 3, WithExpansion(4))
+	now := time.UnixMilli(0).Add(5*time.Hour + time.Minute)
+	s.now = func() time.Time {
+		return now
+	}
+	ctx := t.Context()
+
+	exists, err := s.Exists(ctx, "key-1")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	// 每一代第一次使用的时候按照配置创建，并且在 generations 个周期之后过期
+	assert.Equal(t, [][]any{{"BF.RESERVE", "filter:5", 0.01, int64(1000), "EXPANSION", int64(4)}},
+		f.commands("BF.RESERVE"))
+	assert.Equal(t, time.UnixMilli(0).Add(8*time.Hour), f.expireAt["filter:5"])
+
+	// 轮换之后依旧能查到之前的代里面的 key，并且不会写入新的一代
+	now = now.Add(time.Hour)
+	exists, err = s.Exists(ctx, "key-1")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = s.Exists(ctx, "key-2")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, time.UnixMilli(0).Add(9*time.Hour), f.expireAt["filter:6"])
+	assert.NotContains(t, f.filters["filter:6"], "key-1")
+	assert.Contains(t, f.filters["filter:6"], "key-2")
+	exists, err = s.Peek(ctx, "key-2")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	// 超过 generations 代之后最老的一代不再被查询
+	now = now.Add(2 * time.Hour)
+	res, err := s.MExists(ctx, "key-1", "key-2")
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, true}, res)
+	assert.Len(t, f.commands("BF.RESERVE"), 3)
+}
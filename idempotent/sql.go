@@ -0,0 +1,227 @@
+package idempotent
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rermrf/emo/cronjobx"
+)
+
+var _ ManageableIdempotencyService = (*SQLIdempotencyService)(nil)
+
+// Dialect 不同数据库在插入冲突和占位符上的差异
+type Dialect interface {
+	// InsertIgnore 返回插入一行的语句，主键冲突时什么都不做，参数依次是 key 和过期时间
+	InsertIgnore(table string) string
+	// Placeholder 第 i 个参数的占位符，i 从 1 开始
+	Placeholder(i int) string
+}
+
+var (
+	// DialectSQLite 和 DialectPostgres 使用 ON CONFLICT DO NOTHING
+	DialectSQLite   Dialect = onConflictDialect{placeholder: questionPlaceholder}
+	DialectPostgres Dialect = onConflictDialect{placeholder: dollarPlaceholder}
+	// DialectMySQL 使用 ON DUPLICATE KEY UPDATE，INSERT IGNORE 会把其它错误也降级成警告
+	// 依赖没有冲突时影响行数为 0，DSN 里面不能打开 clientFoundRows
+	DialectMySQL Dialect = mysqlDialect{}
+)
+
+type onConflictDialect struct {
+	placeholder func(i int) string
+}
+
+func (d onConflictDialect) InsertIgnore(table string) string {
+	return "INSERT INTO " + table + " (idem_key, expire_at) VALUES (" +
+		d.placeholder(1) + ", " + d.placeholder(2) + ") ON CONFLICT (idem_key) DO NOTHING"
+}
+
+func (d onConflictDialect) Placeholder(i int) string {
+	return d.placeholder(i)
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) InsertIgnore(table string) string {
+	return "INSERT INTO " + table + " (idem_key, expire_at) VALUES (?, ?) ON DUPLICATE KEY UPDATE idem_key = idem_key"
+}
+
+func (mysqlDialect) Placeholder(int) string {
+	return "?"
+}
+
+func questionPlaceholder(int) string {
+	return "?"
+}
+
+func dollarPlaceholder(i int) string {
+	return "$" + strconv.Itoa(i)
+}
+
+// SQLExecutor *sql.DB 和 *sql.Tx 都满足这个接口
+type SQLExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// SQLIdempotencyService 基于数据库唯一约束的幂等服务
+// 通过 WithTx 加入业务的事务之后，幂等键和业务数据一起提交或者一起回滚。
+// 表结构需要提前创建，例如：
+//
+//	CREATE TABLE idempotency_keys (
+//	    idem_key  CHAR(64) NOT NULL PRIMARY KEY,
+//	    expire_at BIGINT   NOT NULL
+//	);
+//	CREATE INDEX idx_expire_at ON idempotency_keys (expire_at);
+//
+// idem_key 保存的是 key 的 SHA-256 十六进制，长度固定，不会因为 key 太长被截断之后和其它 key 冲突。
+// expire_at 是毫秒时间戳，过期的记录由 CleanupJob 定期删除
+type SQLIdempotencyService struct {
+	db      SQLExecutor
+	dialect Dialect
+	table   string
+	expiry  time.Duration
+	now     func() time.Time
+}
+
+// SQLOption SQLIdempotencyService 的配置项
+type SQLOption func(s *SQLIdempotencyService)
+
+// WithTable 设置表名，默认是 idempotency_keys
+func WithTable(table string) SQLOption {
+	return func(s *SQLIdempotencyService) {
+		s.table = table
+	}
+}
+
+// NewSQLIdempotencyService db 一般是 *sql.DB，需要加入事务的时候使用 WithTx
+// expiry 小于等于 0 表示不过期
+func NewSQLIdempotencyService(db SQLExecutor, dialect Dialect, expiry time.Duration, opts ...SQLOption) *SQLIdempotencyService {
+	s := &SQLIdempotencyService{
+		db:      db,
+		dialect: dialect,
+		table:   "idempotency_keys",
+		expiry:  expiry,
+		now:     time.Now,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithTx 返回一个在 tx 里面执行的副本，幂等键随着 tx 一起提交或者回滚
+// 在 tx 提交之前，并发的重复请求会阻塞在唯一约束上，直到 tx 结束
+func (s *SQLIdempotencyService) WithTx(tx *sql.Tx) *SQLIdempotencyService {
+	res := *s
+	res.db = tx
+	return &res
+}
+
+func (s *SQLIdempotencyService) Exists(ctx context.Context, key string) (bool, error) {
+	res, err := s.MExists(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	return res[0], nil
+}
+
+// MExists 逐个插入 key，没有使用 WithTx 的时候每个 key 单独提交
+func (s *SQLIdempotencyService) MExists(ctx context.Context, keys ...string) ([]bool, error) {
+	if len(keys) == 0 {
+		return []bool{}, nil
+	}
+	now := s.now()
+	// expiry 小于等于 0 表示不过期，和 RedisIdempotencyService 一致
+	expireAt := int64(math.MaxInt64)
+	if s.expiry > 0 {
+		expireAt = now.Add(s.expiry).UnixMilli()
+	}
+	// 已经过期但是还没有被清理的记录不算存在，先删掉再插入
+	deleteExpired := "DELETE FROM " + s.table + " WHERE idem_key = " + s.dialect.Placeholder(1) +
+		" AND expire_at <= " + s.dialect.Placeholder(2)
+	insert := s.dialect.InsertIgnore(s.table)
+	results := make([]bool, len(keys))
+	for i, key := range keys {
+		key = hashSQLKey(key)
+		if _, err := s.db.ExecContext(ctx, deleteExpired, key, now.UnixMilli()); err != nil {
+			return nil, err
+		}
+		res, err := s.db.ExecContext(ctx, insert, key, expireAt)
+		if err != nil {
+			return nil, err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		results[i] = affected == 0
+	}
+	return results, nil
+}
+
+func (s *SQLIdempotencyService) Peek(ctx context.Context, key string) (bool, error) {
+	var one int
+	err := s.db.QueryRowContext(ctx, "SELECT 1 FROM "+s.table+" WHERE idem_key = "+s.dialect.Placeholder(1)+
+		" AND expire_at > "+s.dialect.Placeholder(2), hashSQLKey(key), s.now().UnixMilli()).Scan(&one)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+// Release 在 WithTx 的副本上调用时，删除随着事务一起生效
+func (s *SQLIdempotencyService) Release(ctx context.Context, key string) error {
+	return s.Forget(ctx, key)
+}
+
+func (s *SQLIdempotencyService) Forget(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	args := make([]any, len(keys))
+	placeholders := make([]string, len(keys))
+	for i, key := range keys {
+		args[i] = hashSQLKey(key)
+		placeholders[i] = s.dialect.Placeholder(i + 1)
+	}
+	_, err := s.db.ExecContext(ctx, "DELETE FROM "+s.table+" WHERE idem_key IN ("+strings.Join(placeholders, ", ")+")", args...)
+	return err
+}
+
+// hashSQLKey 数据库里面保存的 idem_key
+func hashSQLKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CleanupJob 返回删除过期记录的定时任务，可以通过 cronjobx.CronJobBuilder 注册
+func (s *SQLIdempotencyService) CleanupJob() *SQLCleanupJob {
+	return &SQLCleanupJob{svc: s}
+}
+
+var _ cronjobx.Job = (*SQLCleanupJob)(nil)
+
+// SQLCleanupJob 删除 SQLIdempotencyService 里面过期的记录
+type SQLCleanupJob struct {
+	svc *SQLIdempotencyService
+}
+
+func (j *SQLCleanupJob) Name() string {
+	return "idempotency_cleanup:" + j.svc.table
+}
+
+func (j *SQLCleanupJob) Run(ctx context.Context) error {
+	_, err := j.svc.db.ExecContext(ctx, "DELETE FROM "+j.svc.table+" WHERE expire_at <= "+j.svc.dialect.Placeholder(1),
+		j.svc.now().UnixMilli())
+	return err
+}
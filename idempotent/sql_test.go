@@ -0,0 +1,160 @@
+package idempotent
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `CREATE TABLE idempotency_keys (
+    idem_key  CHAR(64) NOT NULL PRIMARY KEY,
+    expire_at BIGINT   NOT NULL
+)`
+
+func newSQLiteDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	// 内存数据库每个连接都是独立的
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	_, err = db.Exec(sqliteSchema)
+	require.NoError(t, err)
+	return db
+}
+
+func TestSQLImplementation(t *testing.T) {
+	IdempotencyServiceTest{
+		Name: "SQLIdempotencyService",
+		NewService: func() (IdempotencyService, func(), error) {
+			db, err := sql.Open("sqlite", ":memory:")
+			if err != nil {
+				return nil, nil, err
+			}
+			db.SetMaxOpenConns(1)
+			_, err = db.Exec(sqliteSchema)
+			if err != nil {
+				return nil, nil, err
+			}
+			return NewSQLIdempotencyService(db, DialectSQLite, time.Minute), func() {
+				_ = db.Close()
+			}, nil
+		},
+	}.RunTests(t)
+}
+
+func TestSQLIdempotencyService_WithTx(t *testing.T) {
+	db := newSQLiteDB(t)
+	svc := NewSQLIdempotencyService(db, DialectSQLite, time.Minute)
+	ctx := t.Context()
+
+	// 事务回滚之后幂等键也跟着回滚
+	tx, err := db.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	exists, err := svc.WithTx(tx).Exists(ctx, "key")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	require.NoError(t, tx.Rollback())
+
+	// 事务提交之后幂等键才生效
+	tx, err = db.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	exists, err = svc.WithTx(tx).Exists(ctx, "key")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	require.NoError(t, tx.Commit())
+
+	exists, err = svc.Exists(ctx, "key")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestSQLIdempotencyService_Expiry(t *testing.T) {
+	db := newSQLiteDB(t)
+	svc := NewSQLIdempotencyService(db, DialectSQLite, time.Minute)
+	now := time.UnixMilli(1_700_000_000_000)
+	svc.now = func() time.Time {
+		return now
+	}
+	ctx := t.Context()
+
+	res, err := svc.MExists(ctx, "a", "b", "a")
+	require.NoError(t, err)
+	// 同一批里面重复的 key 也算重复
+	assert.Equal(t, []bool{false, false, true}, res)
+
+	now = now.Add(time.Minute)
+	// 过期但是还没有被清理的记录不算存在
+	exists, err := svc.Exists(ctx, "a")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	job := svc.CleanupJob()
+	assert.Equal(t, "idempotency_cleanup:idempotency_keys", job.Name())
+	require.NoError(t, job.Run(ctx))
+	var cnt int
+	require.NoError(t, db.QueryRowContext(ctx, "SELECT COUNT(*) FROM idempotency_keys").Scan(&cnt))
+	// b 被清理，a 重新写入之后还没有过期
+	assert.Equal(t, 1, cnt)
+}
+
+func TestDialect_InsertIgnore(t *testing.T) {
+	assert.Equal(t, "INSERT INTO t (idem_key, expire_at) VALUES ($1, $2) ON CONFLICT (idem_key) DO NOTHING",
+		DialectPostgres.InsertIgnore("t"))
+	assert.Equal(t, "INSERT INTO t (idem_key, expire_at) VALUES (?, ?) ON DUPLICATE KEY UPDATE idem_key = idem_key",
+		DialectMySQL.InsertIgnore("t"))
+}
+
+func TestSQLIdempotencyService_LongKey(t *testing.T) {
+	db := newSQLiteDB(t)
+	svc := NewSQLIdempotencyService(db, DialectSQLite, time.Minute)
+	ctx := t.Context()
+
+	// 前缀相同的长 key 保存的是固定长度的哈希，不会被截断之后互相冲突
+	prefix := strings.Repeat("k", 300)
+	res, err := svc.MExists(ctx, prefix+"1", prefix+"2")
+	require.NoError(t, err)
+	assert.Equal(t, []bool{false, false}, res)
+
+	var key string
+	require.NoError(t, db.QueryRowContext(ctx, "SELECT idem_key FROM idempotency_keys LIMIT 1").Scan(&key))
+	assert.Len(t, key, 64)
+
+	require.NoError(t, svc.Forget(ctx, prefix+"1"))
+	exists, err := svc.Peek(ctx, prefix+"1")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	exists, err = svc.Peek(ctx, prefix+"2")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestSQLIdempotencyService_NoExpiry(t *testing.T) {
+	db := newSQLiteDB(t)
+	svc := NewSQLIdempotencyService(db, DialectSQLite, 0)
+	now := time.Now()
+	svc.now = func() time.Time {
+		return now
+	}
+	ctx := t.Context()
+
+	exists, err := svc.Exists(ctx, "key")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	now = now.Add(24 * time.Hour)
+	exists, err = svc.Exists(ctx, "key")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	// 清理任务也不会删掉
+	require.NoError(t, svc.CleanupJob().Run(ctx))
+	exists, err = svc.Peek(ctx, "key")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
@@ -1,9 +1,186 @@
 package idempotent
 
-import "context"
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrFingerprintMismatch 同一个幂等键被用在了不同的请求上
+	ErrFingerprintMismatch = errors.New("idempotent: 幂等键对应的请求指纹不一致")
+	// ErrResultTooLarge 保存的处理结果超过了大小限制
+	ErrResultTooLarge = errors.New("idempotent: 处理结果超过了大小限制")
+	// ErrLeaseLost 执行权的租期已经过了，并且被其它请求拿走，或者记录已经不是处理中的状态
+	ErrLeaseLost = errors.New("idempotent: 执行权已经失效")
+	// ErrUnsupported 实现不支持这个操作，例如从布隆过滤器里面删除 key
+	// errors.Is(err, errors.ErrUnsupported) 同样成立
+	ErrUnsupported = fmt.Errorf("idempotent: 不支持的操作: %w", errors.ErrUnsupported)
+)
 
 type IdempotencyService interface {
 	// Exists 这里的Exist是包含添加语义的，返回true表示已经存在，返回false表示不存在，且将key添加到缓存中，下面的MExusts也是同理
 	Exists(ctx context.Context, key string) (bool, error)
 	MExists(ctx context.Context, keys ...string) ([]bool, error)
 }
+
+// ManageableIdempotencyService 支持查询和撤销的幂等服务
+// 需要这些操作的地方通过类型断言判断，不支持删除的实现返回 ErrUnsupported
+type ManageableIdempotencyService interface {
+	IdempotencyService
+	// Peek 只检查 key 是否存在，不会添加，返回 true 表示现在调用 Exists 会被当成重复
+	Peek(ctx context.Context, key string) (bool, error)
+	// Release 撤销 key 的标记，一般用在业务回滚之后，让同一个 key 可以重新执行
+	Release(ctx context.Context, key string) error
+	// Forget 批量清除 key，一般用在需要重放消息的时候
+	Forget(ctx context.Context, keys ...string) error
+}
+
+// KeyResult 批量检查时每个 key 的结果
+type KeyResult struct {
+	Key string
+	// Exists 和 MExists 的返回值含义一致
+	Exists bool
+	// Err 不为 nil 表示这个 key 的状态未知：可能没有被记录，也可能已经记录了但是结果没有返回，
+	// 重试的时候可能会被当成重复
+	Err error
+}
+
+// MExistsError MExists 部分失败时返回的错误，Results 里面是每个 key 的结果，
+// 没有出错的 key 已经被记录了，重试的时候会被当成重复，出错的 key 的状态未知
+type MExistsError struct {
+	Results []KeyResult
+}
+
+func (e *MExistsError) Error() string {
+	failed := 0
+	var first error
+	for _, res := range e.Results {
+		if res.Err != nil {
+			failed++
+			if first == nil {
+				first = res.Err
+			}
+		}
+	}
+	return fmt.Sprintf("idempotent: %d/%d 个 key 检查失败: %v", failed, len(e.Results), first)
+}
+
+func (e *MExistsError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Results))
+	for _, res := range e.Results {
+		if res.Err != nil {
+			errs = append(errs, res.Err)
+		}
+	}
+	return errs
+}
+
+// State 幂等键的处理状态
+type State int
+
+const (
+	// StateNew 第一次出现，调用者拿到了执行权
+	StateNew State = iota
+	// StateInProgress 其它请求正在处理，调用者应当放弃
+	StateInProgress
+	// StateCompleted 已经处理成功，调用者应当放弃
+	StateCompleted
+	// StateFailed 上一次处理失败，调用者拿到了执行权，可以重试
+	StateFailed
+)
+
+// Acquired 调用者是否拿到了执行权
+func (s State) Acquired() bool {
+	return s == StateNew || s == StateFailed
+}
+
+func (s State) String() string {
+	switch s {
+	case StateNew:
+		return "new"
+	case StateInProgress:
+		return "in_progress"
+	case StateCompleted:
+		return "completed"
+	case StateFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// Record Begin 返回的幂等键记录
+type Record struct {
+	State State
+	// Result 处理成功时通过 Complete 保存的结果，只有 StateCompleted 的时候才有值
+	Result []byte
+	// Token 拿到执行权的时候才有值，标识这一次执行，Complete 和 Fail 的时候需要带上
+	Token string
+}
+
+// BeginOption Begin 的配置项
+type BeginOption func(o *beginOptions)
+
+type beginOptions struct {
+	fingerprint string
+}
+
+func newBeginOptions(opts []BeginOption) beginOptions {
+	var o beginOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithFingerprint 设置请求的指纹，一般是请求体的摘要，可以用 Fingerprint 计算
+// 同一个 key 带着不同的指纹再次 Begin 时会返回 ErrFingerprintMismatch
+func WithFingerprint(fingerprint string) BeginOption {
+	return func(o *beginOptions) {
+		o.fingerprint = fingerprint
+	}
+}
+
+// Fingerprint 计算请求体的指纹
+func Fingerprint(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// StatefulIdempotencyService 两阶段的幂等服务
+// 和 Exists 不同，业务执行失败之后可以重试，而并发的重复请求依旧会被拦住，
+// 已经处理成功的重复请求可以拿到第一次处理的结果
+//
+//	record, err := svc.Begin(ctx, key, idempotent.WithFingerprint(idempotent.Fingerprint(body)))
+//	if err != nil {
+//		return
+//	}
+//	switch record.State {
+//	case idempotent.StateCompleted:
+//		return record.Result
+//	case idempotent.StateInProgress:
+//		return
+//	}
+//	res, err := biz()
+//	if err != nil {
+//		_ = svc.Fail(ctx, key, record.Token)
+//		return
+//	}
+//	_ = svc.Complete(ctx, key, record.Token, res)
+type StatefulIdempotencyService interface {
+	// Begin 开始处理，返回 StateNew 或者 StateFailed 的时候调用者拿到了执行权，
+	// 执行权有租期，租期内没有调用 Complete 或者 Fail，其它请求可以重新拿到执行权
+	// 每次拿到执行权都会生成一个新的 Record.Token
+	Begin(ctx context.Context, key string, opts ...BeginOption) (Record, error)
+	// Complete 标记处理成功，并保存处理结果，result 可以为 nil
+	// 后续的 Begin 都会返回 StateCompleted 和这个结果
+	// token 的要求和 Fail 一样，执行权失效的时候返回 ErrLeaseLost，不会覆盖其它请求的记录
+	Complete(ctx context.Context, key string, token string, result []byte) error
+	// Fail 标记处理失败，下一次 Begin 会返回 StateFailed 并拿到执行权
+	// token 是 Begin 返回的 Record.Token，租期已经过了或者执行权被其它请求拿走的时候返回 ErrLeaseLost，
+	// 避免租期过了之后才返回的请求把正在执行的请求标记成失败
+	Fail(ctx context.Context, key string, token string) error
+}
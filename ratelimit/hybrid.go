@@ -0,0 +1,245 @@
+package ratelimit
+
+import (
+	"context"
+	_ "embed"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+//go:embed hybrid_merge.lua
+var luaHybridMerge string
+
+var hybridMergeScript = redis.NewScript(luaHybridMerge)
+
+var _ ThresholdLimiter = (*HybridLimiter)(nil)
+
+// HybridLimiter 本地预聚合 + 定期同步 Redis 的固定窗口限流器
+// 适用于 QPS 很高的限流对象：绝大部分 Limit 调用只访问本地计数，
+// 每隔 flushInterval 或者本地累积了 flushHits 次请求之后，才把增量通过 lua 脚本合并到 Redis 上
+//
+// 超额放行的上界：
+// 每个节点在两次同步之间最多放行 flushHits 个请求，放行前会检查 上次同步的全局计数 + 本地未同步计数 < rate，
+// 因此在 N 个节点共享同一个限流对象时，一个窗口内放行的请求数不会超过 rate + (N-1)*flushHits。
+// 单节点时不会超额放行。flushInterval 只会让同步更频繁，不影响这个上界
+type HybridLimiter struct {
+	cmd redis.Cmdable
+	// 窗口大小
+	interval time.Duration
+	// 阈值
+	rate int64
+	// 定期同步的间隔
+	flushInterval time.Duration
+	// 本地最多累积多少次请求就必须同步
+	flushHits int64
+	opts      redisOptions
+
+	mu       sync.Mutex
+	counters map[string]*hybridCounter
+
+	now       func() time.Time
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type hybridCounter struct {
+	mu sync.Mutex
+	// 当前窗口编号
+	window int64
+	// 上次同步时 Redis 上的全局计数
+	synced int64
+	// 本地尚未同步到 Redis 的计数
+	pending int64
+	// 已经从 counters 中移除
+	evicted bool
+}
+
+// NewHybridLimiter 创建一个本地预聚合的限流器，并启动后台同步的 goroutine
+// 使用完毕之后需要调用 Close 把本地剩余的计数同步到 Redis
+// interval 不能小于 1 毫秒，flushInterval 必须大于 0，否则会 panic
+func NewHybridLimiter(cmd redis.Cmdable, interval time.Duration, rate int,
+	flushInterval time.Duration, flushHits int, opts ...Option) *HybridLimiter {
+	if interval < time.Millisecond {
+		panic("ratelimit: HybridLimiter 的窗口大小不能小于 1 毫秒")
+	}
+	if flushInterval <= 0 {
+		panic("ratelimit: HybridLimiter 的同步间隔必须大于 0")
+	}
+	if flushHits <= 0 {
+		flushHits = 1
+	}
+	h := &HybridLimiter{
+		cmd:           cmd,
+		interval:      interval,
+		rate:          int64(rate),
+		flushInterval: flushInterval,
+		flushHits:     int64(flushHits),
+		opts:          newRedisOptions(opts),
+		counters:      make(map[string]*hybridCounter),
+		now:           time.Now,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go h.loop()
+	return h
+}
+
+func (h *HybridLimiter) Limit(ctx context.Context, key string) (bool, error) {
+	return h.limitWithThreshold(ctx, key, h.rate)
+}
+
+// LimitWithRatio 超额放行的上界和 Limit 一样，只是 rate 换成了按比例计算的阈值
+func (h *HybridLimiter) LimitWithRatio(ctx context.Context, key string, ratio float64) (bool, error) {
+	return h.limitWithThreshold(ctx, key, int64(ratioThreshold(int(h.rate), ratio)))
+}
+
+func (h *HybridLimiter) limitWithThreshold(ctx context.Context, key string, threshold int64) (bool, error) {
+	window := h.window()
+	for {
+		c := h.counter(key)
+		c.mu.Lock()
+		if c.evicted {
+			// 刚好被后台清理掉了，重新获取
+			c.mu.Unlock()
+			continue
+		}
+		limited, err := h.limit(ctx, key, c, window, threshold)
+		c.mu.Unlock()
+		return limited, err
+	}
+}
+
+func (h *HybridLimiter) limit(ctx context.Context, key string, c *hybridCounter, window int64, threshold int64) (bool, error) {
+	if c.window != window {
+		if err := h.roll(ctx, key, c, window); err != nil {
+			return false, err
+		}
+	}
+	if c.pending >= h.flushHits {
+		// 本地累积的计数已经达到上限，必须先同步才能继续放行
+		if err := h.sync(ctx, key, c); err != nil {
+			return false, err
+		}
+	}
+	if c.synced+c.pending >= threshold {
+		return true, nil
+	}
+	c.pending++
+	return false, nil
+}
+
+// Close 停止后台同步，并把本地剩余的计数同步到 Redis
+func (h *HybridLimiter) Close() error {
+	h.closeOnce.Do(func() {
+		close(h.stop)
+	})
+	<-h.done
+	return h.flush(context.Background())
+}
+
+func (h *HybridLimiter) loop() {
+	defer close(h.done)
+	ticker := time.NewTicker(h.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), h.flushInterval)
+			// 后台同步失败时保留本地计数，下一次同步会重试，Limit 中的同步会把错误返回给调用者
+			_ = h.flush(ctx)
+			cancel()
+		}
+	}
+}
+
+// flush 同步所有本地计数，并清理已经过期的窗口
+func (h *HybridLimiter) flush(ctx context.Context) error {
+	window := h.window()
+	h.mu.Lock()
+	keys := make([]string, 0, len(h.counters))
+	counters := make([]*hybridCounter, 0, len(h.counters))
+	for key, c := range h.counters {
+		keys = append(keys, key)
+		counters = append(counters, c)
+	}
+	h.mu.Unlock()
+
+	var lastErr error
+	for i, c := range counters {
+		c.mu.Lock()
+		switch {
+		case c.window != window:
+			// 窗口已经过期，同步完剩余的计数之后移除，同步失败的时候留到下一次重试
+			if c.pending > 0 {
+				if err := h.sync(ctx, keys[i], c); err != nil {
+					lastErr = err
+					break
+				}
+			}
+			h.evict(keys[i], c)
+		case c.pending > 0:
+			if err := h.sync(ctx, keys[i], c); err != nil {
+				lastErr = err
+			}
+		}
+		c.mu.Unlock()
+	}
+	return lastErr
+}
+
+// sync 把本地计数合并到 Redis，调用者需要持有 c.mu
+func (h *HybridLimiter) sync(ctx context.Context, key string, c *hybridCounter) error {
+	redisKey := h.opts.key(key, strconv.FormatInt(c.window, 10))
+	// 多保留一个窗口，避免各个节点的时钟有偏差时提前过期
+	ttl := 2 * h.interval.Milliseconds()
+	total, err := hybridMergeScript.Run(ctx, h.cmd, []string{redisKey}, c.pending, ttl).Int64()
+	if err != nil {
+		return err
+	}
+	c.synced = total
+	c.pending = 0
+	return nil
+}
+
+// roll 进入新的窗口，上一个窗口还没同步的计数要先合并到 Redis，
+// 否则其它还停留在上一个窗口的节点看不到这部分请求。调用者需要持有 c.mu
+func (h *HybridLimiter) roll(ctx context.Context, key string, c *hybridCounter, window int64) error {
+	if c.pending > 0 {
+		if err := h.sync(ctx, key, c); err != nil {
+			return err
+		}
+	}
+	c.window, c.synced, c.pending = window, 0, 0
+	return nil
+}
+
+func (h *HybridLimiter) counter(key string) *hybridCounter {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, ok := h.counters[key]
+	if !ok {
+		c = &hybridCounter{window: h.window()}
+		h.counters[key] = c
+	}
+	return c
+}
+
+// evict 调用者需要持有 c.mu
+func (h *HybridLimiter) evict(key string, c *hybridCounter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counters[key] == c {
+		delete(h.counters, key)
+	}
+	c.evicted = true
+}
+
+func (h *HybridLimiter) window() int64 {
+	return h.now().UnixMilli() / h.interval.Milliseconds()
+}
@@ -0,0 +1,13 @@
+-- 把本地累积的计数合并到 Redis 上，并返回合并之后的全局计数
+local key = KEYS[1]
+-- 本地尚未同步的计数
+local delta = tonumber(ARGV[1])
+-- 过期时间，单位毫秒
+local ttl = tonumber(ARGV[2])
+
+local cnt = redis.call('INCRBY', key, delta)
+if cnt == delta then
+    -- 窗口内第一次合并，设置过期时间
+    redis.call('PEXPIRE', key, ttl)
+end
+return cnt
@@ -0,0 +1,175 @@
+package ratelimit
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestHybridLimiter(t *testing.T, client redis.Cmdable, rate, flushHits int, flushInterval time.Duration) *HybridLimiter {
+	t.Helper()
+	h := NewHybridLimiter(client, time.Minute, rate, flushInterval, flushHits, WithKeyPrefix("ratelimit"), WithHashTag())
+	t.Cleanup(func() {
+		_ = h.Close()
+	})
+	return h
+}
+
+func TestHybridLimiter_SingleNode(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := t.Context()
+
+	// 单节点不会超额放行
+	h := newTestHybridLimiter(t, client, 10, 3, time.Hour)
+	admitted := 0
+	for i := 0; i < 30; i++ {
+		limited, err := h.Limit(ctx, "hot")
+		require.NoError(t, err)
+		if !limited {
+			admitted++
+		}
+	}
+	assert.Equal(t, 10, admitted)
+}
+
+func TestHybridLimiter_OverAdmissionBound(t *testing.T) {
+	const (
+		nodes     = 3
+		rate      = 20
+		flushHits = 5
+	)
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := t.Context()
+
+	limiters := make([]*HybridLimiter, nodes)
+	for i := range limiters {
+		limiters[i] = newTestHybridLimiter(t, client, rate, flushHits, time.Hour)
+	}
+	admitted := 0
+	for i := 0; i < 100*nodes; i++ {
+		limited, err := limiters[i%nodes].Limit(ctx, "hot")
+		require.NoError(t, err)
+		if !limited {
+			admitted++
+		}
+	}
+	assert.GreaterOrEqual(t, admitted, rate)
+	assert.LessOrEqual(t, admitted, rate+(nodes-1)*flushHits)
+}
+
+func TestHybridLimiter_PeriodicFlush(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := t.Context()
+
+	h := newTestHybridLimiter(t, client, 100, 50, 10*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		limited, err := h.Limit(ctx, "hot")
+		require.NoError(t, err)
+		assert.False(t, limited)
+	}
+	assert.Eventually(t, func() bool {
+		keys, err := client.Keys(ctx, "ratelimit:{hot}:*").Result()
+		if err != nil || len(keys) != 1 {
+			return false
+		}
+		val, err := client.Get(ctx, keys[0]).Int()
+		return err == nil && val == 3
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestHybridLimiter_WindowReset(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := t.Context()
+
+	h := newTestHybridLimiter(t, client, 2, 1, time.Hour)
+	now := time.UnixMilli(0).Add(time.Hour)
+	h.now = func() time.Time {
+		return now
+	}
+	for i := 0; i < 2; i++ {
+		limited, err := h.Limit(ctx, "hot")
+		require.NoError(t, err)
+		assert.False(t, limited)
+	}
+	limited, err := h.Limit(ctx, "hot")
+	require.NoError(t, err)
+	assert.True(t, limited)
+
+	// 进入下一个窗口之后重新计数
+	now = now.Add(time.Minute)
+	limited, err = h.Limit(ctx, "hot")
+	require.NoError(t, err)
+	assert.False(t, limited)
+}
+
+func TestHybridLimiter_Close(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := t.Context()
+
+	h := NewHybridLimiter(client, time.Minute, 100, time.Hour, 50)
+	for i := 0; i < 4; i++ {
+		_, err := h.Limit(ctx, "hot")
+		require.NoError(t, err)
+	}
+	require.NoError(t, h.Close())
+	keys, err := client.Keys(ctx, "hot:*").Result()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	val, err := client.Get(ctx, keys[0]).Int()
+	require.NoError(t, err)
+	assert.Equal(t, 4, val)
+}
+
+func TestHybridLimiter_RollOverFlush(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := t.Context()
+
+	h := newTestHybridLimiter(t, client, 100, 50, time.Hour)
+	now := time.UnixMilli(0).Add(time.Hour)
+	h.now = func() time.Time {
+		return now
+	}
+	window := h.window()
+	for i := 0; i < 3; i++ {
+		_, err := h.Limit(ctx, "hot")
+		require.NoError(t, err)
+	}
+
+	// 进入下一个窗口之前，上一个窗口没同步的计数要先写到 Redis
+	now = now.Add(time.Minute)
+	_, err := h.Limit(ctx, "hot")
+	require.NoError(t, err)
+	val, err := client.Get(ctx, h.opts.key("hot", strconv.FormatInt(window, 10))).Int()
+	require.NoError(t, err)
+	assert.Equal(t, 3, val)
+
+	// 后台清理过期窗口的时候也一样
+	_, err = h.Limit(ctx, "cold")
+	require.NoError(t, err)
+	now = now.Add(time.Minute)
+	require.NoError(t, h.flush(ctx))
+	val, err = client.Get(ctx, h.opts.key("cold", strconv.FormatInt(window+1, 10))).Int()
+	require.NoError(t, err)
+	assert.Equal(t, 1, val)
+}
+
+func TestNewHybridLimiter_InvalidArguments(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	assert.Panics(t, func() {
+		NewHybridLimiter(client, 0, 10, time.Second, 10)
+	})
+	assert.Panics(t, func() {
+		NewHybridLimiter(client, time.Minute, 10, 0, 10)
+	})
+}
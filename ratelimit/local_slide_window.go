@@ -0,0 +1,128 @@
+package ratelimit
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	_ BlockingLimiter  = (*LocalSlidingWindowLimiter)(nil)
+	_ ThresholdLimiter = (*LocalSlidingWindowLimiter)(nil)
+)
+
+// LocalSlidingWindowLimiter 本地内存的滑动窗口算法限流器实现，语义和 RedisSlidingWindowLimiter 一致
+// 适合单机部署或者测试
+type LocalSlidingWindowLimiter struct {
+	mu sync.Mutex
+	// 窗口大小
+	interval time.Duration
+	// 阈值
+	rate int
+	// 每个限流对象在窗口内的许可，按照时间排序，可能包含预约的未来的许可
+	permits map[string][]*localPermit
+}
+
+type localPermit struct {
+	at time.Time
+}
+
+// NewLocalSlidingWindowLimiter rate 必须大于 0，否则会 panic
+func NewLocalSlidingWindowLimiter(interval time.Duration, rate int) *LocalSlidingWindowLimiter {
+	if rate <= 0 {
+		panic("ratelimit: 滑动窗口的阈值必须大于 0")
+	}
+	return &LocalSlidingWindowLimiter{
+		interval: interval,
+		rate:     rate,
+		permits:  make(map[string][]*localPermit),
+	}
+}
+
+func (l *LocalSlidingWindowLimiter) Limit(ctx context.Context, key string) (bool, error) {
+	return l.limit(key, l.rate), nil
+}
+
+func (l *LocalSlidingWindowLimiter) LimitWithRatio(ctx context.Context, key string, ratio float64) (bool, error) {
+	return l.limit(key, ratioThreshold(l.rate, ratio)), nil
+}
+
+func (l *LocalSlidingWindowLimiter) limit(key string, threshold int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	permits := l.prune(key, now)
+	if len(permits) >= threshold {
+		return true
+	}
+	l.insert(key, &localPermit{at: now})
+	return false
+}
+
+func (l *LocalSlidingWindowLimiter) Wait(ctx context.Context, key string) error {
+	return wait(ctx, l, key)
+}
+
+func (l *LocalSlidingWindowLimiter) Reserve(ctx context.Context, key string) (Reservation, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	permits := l.prune(key, now)
+	p := &localPermit{at: now}
+	if cnt := len(permits); cnt >= l.rate {
+		// 要等到第 cnt-rate+1 个许可滑出窗口才有空位
+		p.at = permits[cnt-l.rate].at.Add(l.interval)
+	}
+	l.insert(key, p)
+	return Reservation{
+		at: p.at,
+		cancel: func(ctx context.Context) error {
+			l.remove(key, p)
+			return nil
+		},
+	}, nil
+}
+
+// prune 移除已经滑出窗口的许可，调用者需要持有 mu
+func (l *LocalSlidingWindowLimiter) prune(key string, now time.Time) []*localPermit {
+	permits := l.permits[key]
+	start := now.Add(-l.interval)
+	i := 0
+	for i < len(permits) && !permits[i].at.After(start) {
+		i++
+	}
+	permits = permits[i:]
+	if len(permits) == 0 {
+		delete(l.permits, key)
+		return nil
+	}
+	l.permits[key] = permits
+	return permits
+}
+
+// insert 按照时间顺序插入许可，调用者需要持有 mu
+func (l *LocalSlidingWindowLimiter) insert(key string, p *localPermit) {
+	permits := l.permits[key]
+	i, _ := slices.BinarySearchFunc(permits, p.at, func(e *localPermit, at time.Time) int {
+		if e.at.After(at) {
+			return 1
+		}
+		// 相同时间的许可插在后面
+		return -1
+	})
+	l.permits[key] = slices.Insert(permits, i, p)
+}
+
+func (l *LocalSlidingWindowLimiter) remove(key string, p *localPermit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	permits := slices.DeleteFunc(l.permits[key], func(e *localPermit) bool {
+		return e == p
+	})
+	if len(permits) == 0 {
+		delete(l.permits, key)
+		return
+	}
+	l.permits[key] = permits
+}
@@ -0,0 +1,58 @@
+package ratelimit
+
+import "strings"
+
+// Option Redis 限流器的配置项
+type Option func(o *redisOptions)
+
+type redisOptions struct {
+	// key 前缀，用于区分不同业务共用一个 Redis 的情况
+	prefix string
+	// 是否用 {} 包裹限流对象
+	hashTag bool
+}
+
+func newRedisOptions(opts []Option) redisOptions {
+	var o redisOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithKeyPrefix 设置限流 key 的前缀，例如 "ratelimit:sms"
+func WithKeyPrefix(prefix string) Option {
+	return func(o *redisOptions) {
+		o.prefix = strings.TrimSuffix(prefix, ":")
+	}
+}
+
+// WithHashTag 用 {} 包裹限流对象，保证同一个限流对象的所有 key 落在同一个 slot 上
+// 在 Redis Cluster 上执行多 key 的 lua 脚本时必须开启
+func WithHashTag() Option {
+	return func(o *redisOptions) {
+		o.hashTag = true
+	}
+}
+
+// key 拼接限流对象在 Redis 中的 key
+// suffixes 用于多 key 的脚本区分同一个限流对象下的不同数据
+func (o redisOptions) key(key string, suffixes ...string) string {
+	var sb strings.Builder
+	if o.prefix != "" {
+		sb.WriteString(o.prefix)
+		sb.WriteByte(':')
+	}
+	if o.hashTag {
+		sb.WriteByte('{')
+		sb.WriteString(key)
+		sb.WriteByte('}')
+	} else {
+		sb.WriteString(key)
+	}
+	for _, s := range suffixes {
+		sb.WriteByte(':')
+		sb.WriteString(s)
+	}
+	return sb.String()
+}
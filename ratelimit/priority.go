@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+)
+
+// Priority 请求的优先级，数值越大优先级越高
+type Priority int
+
+const (
+	// PriorityLow 批处理等可以延后的流量，最先被丢弃
+	PriorityLow Priority = iota
+	// PriorityNormal 普通流量，没有指定优先级时使用
+	PriorityNormal
+	// PriorityHigh 付费用户等重要流量
+	PriorityHigh
+	// PriorityCritical 健康检查等必须放行的流量，可以用满全部容量
+	PriorityCritical
+)
+
+// defaultPriorityRatios 每个优先级最多可以用到阈值的多少比例，剩下的容量预留给更高的优先级
+var defaultPriorityRatios = map[Priority]float64{
+	PriorityLow:      0.5,
+	PriorityNormal:   0.8,
+	PriorityHigh:     0.95,
+	PriorityCritical: 1,
+}
+
+type priorityKey struct{}
+
+// WithPriority 在 ctx 中设置请求的优先级
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFromContext 获取 ctx 中的优先级，没有设置时返回 PriorityNormal
+func PriorityFromContext(ctx context.Context) Priority {
+	p, ok := ctx.Value(priorityKey{}).(Priority)
+	if !ok {
+		return PriorityNormal
+	}
+	return p
+}
+
+// ThresholdLimiter 可以在调用时调低阈值的限流器
+type ThresholdLimiter interface {
+	Limiter
+	// LimitWithRatio 按照配置阈值的 ratio 倍判断是否限流，ratio 的取值范围是 (0, 1]
+	// 所有 ratio 共用同一份计数
+	LimitWithRatio(ctx context.Context, key string, ratio float64) (bool, error)
+}
+
+var _ Limiter = (*PriorityLimiter)(nil)
+
+// PriorityLimiter 按照优先级丢弃流量的限流器
+// 优先级从 ctx 中获取，所有优先级共用同一份计数，低优先级只能用到阈值的一部分，
+// 利用率升高时会先丢弃低优先级的流量，把剩下的容量留给高优先级
+type PriorityLimiter struct {
+	l      ThresholdLimiter
+	ratios map[Priority]float64
+}
+
+// NewPriorityLimiter 创建一个按照优先级丢弃流量的限流器
+// ratios 指定每个优先级可以用到阈值的比例，没有指定的优先级使用默认比例
+func NewPriorityLimiter(l ThresholdLimiter, ratios map[Priority]float64) *PriorityLimiter {
+	merged := make(map[Priority]float64, len(defaultPriorityRatios)+len(ratios))
+	for p, ratio := range defaultPriorityRatios {
+		merged[p] = ratio
+	}
+	for p, ratio := range ratios {
+		merged[p] = ratio
+	}
+	return &PriorityLimiter{
+		l:      l,
+		ratios: merged,
+	}
+}
+
+func (p *PriorityLimiter) Limit(ctx context.Context, key string) (bool, error) {
+	return p.l.LimitWithRatio(ctx, key, p.ratio(PriorityFromContext(ctx)))
+}
+
+func (p *PriorityLimiter) ratio(priority Priority) float64 {
+	if ratio, ok := p.ratios[priority]; ok {
+		return ratio
+	}
+	// 没有配置的优先级按照最接近的已知优先级处理
+	if priority < PriorityLow {
+		return p.ratios[PriorityLow]
+	}
+	return p.ratios[PriorityCritical]
+}
+
+// ratioThreshold 按照比例计算阈值，向下取整
+func ratioThreshold(rate int, ratio float64) int {
+	if ratio >= 1 {
+		return rate
+	}
+	// 加上一个很小的数，避免 0.29*100 这种浮点误差导致少算一个
+	return int(math.Floor(float64(rate)*max(ratio, 0) + 1e-9))
+}
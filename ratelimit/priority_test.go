@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPriorityFromContext(t *testing.T) {
+	assert.Equal(t, PriorityNormal, PriorityFromContext(context.Background()))
+	ctx := WithPriority(context.Background(), PriorityCritical)
+	assert.Equal(t, PriorityCritical, PriorityFromContext(ctx))
+}
+
+func TestPriorityLimiter_Limit(t *testing.T) {
+	testCases := []struct {
+		name       string
+		newLimiter func(t *testing.T) ThresholdLimiter
+	}{
+		{
+			name: "本地",
+			newLimiter: func(t *testing.T) ThresholdLimiter {
+				return NewLocalSlidingWindowLimiter(time.Minute, 20)
+			},
+		},
+		{
+			name: "Redis",
+			newLimiter: func(t *testing.T) ThresholdLimiter {
+				mr := miniredis.RunT(t)
+				client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+				return NewRedisSlidingWindowLimiter(client, time.Minute, 20)
+			},
+		},
+		{
+			name: "本地预聚合",
+			newLimiter: func(t *testing.T) ThresholdLimiter {
+				mr := miniredis.RunT(t)
+				client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+				return newTestHybridLimiter(t, client, 20, 3, time.Hour)
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := NewPriorityLimiter(tc.newLimiter(t), nil)
+			admit := func(p Priority) int {
+				ctx := WithPriority(t.Context(), p)
+				cnt := 0
+				for i := 0; i < 20; i++ {
+					limited, err := l.Limit(ctx, "key")
+					require.NoError(t, err)
+					if !limited {
+						cnt++
+					}
+				}
+				return cnt
+			}
+			// 阈值 20，低优先级最多用到 50%，之后每个优先级只能用到自己的比例
+			assert.Equal(t, 10, admit(PriorityLow))
+			assert.Equal(t, 6, admit(PriorityNormal))
+			assert.Equal(t, 3, admit(PriorityHigh))
+			assert.Equal(t, 1, admit(PriorityCritical))
+			// 满载之后低优先级全部被丢弃
+			assert.Equal(t, 0, admit(PriorityLow))
+		})
+	}
+}
+
+func TestPriorityLimiter_CustomRatios(t *testing.T) {
+	l := NewPriorityLimiter(NewLocalSlidingWindowLimiter(time.Minute, 10), map[Priority]float64{
+		PriorityLow: 0.2,
+	})
+	ctx := WithPriority(t.Context(), PriorityLow)
+	admitted := 0
+	for i := 0; i < 10; i++ {
+		limited, err := l.Limit(ctx, "key")
+		require.NoError(t, err)
+		if !limited {
+			admitted++
+		}
+	}
+	assert.Equal(t, 2, admitted)
+
+	// 未知的优先级按照最接近的优先级处理
+	assert.Equal(t, 0.2, l.ratio(PriorityLow-1))
+	assert.Equal(t, 1.0, l.ratio(PriorityCritical+1))
+}
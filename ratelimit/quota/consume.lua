@@ -0,0 +1,19 @@
+-- 扣减配额，配额不足时不扣减
+-- 用量排行，member 是对象，score 是用量
+local usedKey = KEYS[1]
+-- 额外发放的配额，field 是对象
+local grantedKey = KEYS[2]
+local member = ARGV[1]
+local n = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+-- 过期时间，单位毫秒
+local ttl = tonumber(ARGV[4])
+
+local used = tonumber(redis.call('ZSCORE', usedKey, member) or 0)
+local granted = tonumber(redis.call('HGET', grantedKey, member) or 0)
+if used + n > limit + granted then
+    return 0
+end
+redis.call('ZINCRBY', usedKey, n, member)
+redis.call('PEXPIRE', usedKey, ttl)
+return 1
@@ -0,0 +1,132 @@
+package quota
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+var _ Service = (*MemoryService)(nil)
+
+// MemoryService 本地内存的配额管理，语义和 RedisService 一致，适合单机工具和测试
+type MemoryService struct {
+	mu     sync.Mutex
+	period Period
+	limit  int64
+	loc    *time.Location
+	now    func() time.Time
+	// 当前周期的开始时间，进入新周期之后清空 entries
+	start   time.Time
+	entries map[string]*memoryEntry
+}
+
+type memoryEntry struct {
+	used    int64
+	granted int64
+}
+
+// NewMemoryService 创建一个本地内存的配额管理服务，loc 为 nil 时使用 time.Local
+func NewMemoryService(period Period, limit int64, loc *time.Location) *MemoryService {
+	if loc == nil {
+		loc = time.Local
+	}
+	return &MemoryService{
+		period:  period,
+		limit:   limit,
+		loc:     loc,
+		now:     time.Now,
+		entries: make(map[string]*memoryEntry),
+	}
+}
+
+func (m *MemoryService) Consume(ctx context.Context, key string, n int64) (bool, error) {
+	if n <= 0 {
+		return false, ErrInvalidAmount
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rotate()
+	e := m.entry(key)
+	if e.used+n > m.limit+e.granted {
+		return false, nil
+	}
+	e.used += n
+	return true, nil
+}
+
+func (m *MemoryService) Usage(ctx context.Context, key string) (Usage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	start, end := m.rotate()
+	usage := Usage{Key: key, Start: start, End: end, Limit: m.limit}
+	if e, ok := m.entries[key]; ok {
+		usage.Used = e.used
+		usage.Granted = e.granted
+	}
+	return usage, nil
+}
+
+func (m *MemoryService) Grant(ctx context.Context, key string, n int64) error {
+	if n <= 0 {
+		return ErrInvalidAmount
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rotate()
+	m.entry(key).granted += n
+	return nil
+}
+
+func (m *MemoryService) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rotate()
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *MemoryService) TopConsumers(ctx context.Context, n int) ([]Consumer, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rotate()
+	res := make([]Consumer, 0, len(m.entries))
+	for key, e := range m.entries {
+		if e.used > 0 {
+			res = append(res, Consumer{Key: key, Used: e.used})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Used != res[j].Used {
+			return res[i].Used > res[j].Used
+		}
+		return res[i].Key > res[j].Key
+	})
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res, nil
+}
+
+// rotate 进入新周期时清空上一个周期的数据，调用者需要持有 mu
+func (m *MemoryService) rotate() (time.Time, time.Time) {
+	start, end := m.period.window(m.now(), m.loc)
+	if !start.Equal(m.start) {
+		m.start = start
+		clear(m.entries)
+	}
+	return start, end
+}
+
+// entry 调用者需要持有 mu
+func (m *MemoryService) entry(key string) *memoryEntry {
+	e, ok := m.entries[key]
+	if !ok {
+		e = &memoryEntry{}
+		m.entries[key] = e
+	}
+	return e
+}
@@ -0,0 +1,34 @@
+package quota
+
+import "time"
+
+// Period 配额的周期
+type Period int
+
+const (
+	// Daily 按自然日
+	Daily Period = iota + 1
+	// Monthly 按自然月
+	Monthly
+)
+
+// window 返回 t 所在周期的起止时间，左闭右开
+func (p Period) window(t time.Time, loc *time.Location) (time.Time, time.Time) {
+	t = t.In(loc)
+	switch p {
+	case Monthly:
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0)
+	default:
+		start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 0, 1)
+	}
+}
+
+// id 周期的标识，用于拼接 key
+func (p Period) id(start time.Time) string {
+	if p == Monthly {
+		return start.Format("200601")
+	}
+	return start.Format("20060102")
+}
@@ -0,0 +1,207 @@
+package quota
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var shanghai = time.FixedZone("Asia/Shanghai", 8*3600)
+
+type ServiceTest struct {
+	Name string
+	// NewService 创建一个东八区每天 10 个配额的服务，now 用来控制当前时间
+	NewService func(t *testing.T, now func() time.Time) Service
+}
+
+func (st ServiceTest) RunTests(t *testing.T) {
+	t.Helper()
+	t.Run("TestConsume", st.TestConsume)
+	t.Run("TestGrantAndReset", st.TestGrantAndReset)
+	t.Run("TestTopConsumers", st.TestTopConsumers)
+	t.Run("TestCalendarWindow", st.TestCalendarWindow)
+}
+
+func (st ServiceTest) TestConsume(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	svc := st.NewService(t, func() time.Time { return now })
+	ctx := t.Context()
+
+	ok, err := svc.Consume(ctx, "tenant-1", 7)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// 配额不足时不扣减
+	ok, err = svc.Consume(ctx, "tenant-1", 4)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = svc.Consume(ctx, "tenant-1", 3)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	usage, err := svc.Usage(ctx, "tenant-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), usage.Used)
+	assert.Equal(t, int64(0), usage.Remaining())
+
+	_, err = svc.Consume(ctx, "tenant-1", 0)
+	assert.ErrorIs(t, err, ErrInvalidAmount)
+}
+
+func (st ServiceTest) TestGrantAndReset(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	svc := st.NewService(t, func() time.Time { return now })
+	ctx := t.Context()
+
+	ok, err := svc.Consume(ctx, "tenant-1", 10)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	require.NoError(t, svc.Grant(ctx, "tenant-1", 5))
+	ok, err = svc.Consume(ctx, "tenant-1", 5)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	usage, err := svc.Usage(ctx, "tenant-1")
+	require.NoError(t, err)
+	assert.Equal(t, Usage{
+		Key:     "tenant-1",
+		Start:   time.Date(2026, 10, 18, 0, 0, 0, 0, shanghai),
+		End:     time.Date(2026, 10, 19, 0, 0, 0, 0, shanghai),
+		Used:    15,
+		Limit:   10,
+		Granted: 5,
+	}, usage)
+
+	require.NoError(t, svc.Reset(ctx, "tenant-1"))
+	usage, err = svc.Usage(ctx, "tenant-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), usage.Used)
+	assert.Equal(t, int64(0), usage.Granted)
+}
+
+func (st ServiceTest) TestTopConsumers(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	svc := st.NewService(t, func() time.Time { return now })
+	ctx := t.Context()
+
+	for key, n := range map[string]int64{"a": 3, "b": 9, "c": 5} {
+		ok, err := svc.Consume(ctx, key, n)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+	top, err := svc.TopConsumers(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []Consumer{{Key: "b", Used: 9}, {Key: "c", Used: 5}}, top)
+}
+
+func (st ServiceTest) TestCalendarWindow(t *testing.T) {
+	// UTC 17 日 16:30 已经是东八区的 18 日
+	now := time.Date(2026, 10, 17, 16, 30, 0, 0, time.UTC)
+	svc := st.NewService(t, func() time.Time { return now })
+	ctx := t.Context()
+
+	ok, err := svc.Consume(ctx, "tenant-1", 10)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	now = now.Add(time.Hour)
+	ok, err = svc.Consume(ctx, "tenant-1", 1)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// 到了东八区 19 日零点，配额重置
+	now = time.Date(2026, 10, 18, 16, 0, 0, 0, time.UTC)
+	usage, err := svc.Usage(ctx, "tenant-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), usage.Used)
+	ok, err = svc.Consume(ctx, "tenant-1", 1)
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestPeriod_Window(t *testing.T) {
+	testCases := []struct {
+		name      string
+		period    Period
+		t         time.Time
+		loc       *time.Location
+		wantStart time.Time
+		wantEnd   time.Time
+		wantID    string
+	}{
+		{
+			name:      "按天",
+			period:    Daily,
+			t:         time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC),
+			loc:       time.UTC,
+			wantStart: time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC),
+			wantID:    "20261018",
+		},
+		{
+			name:      "按天-时区",
+			period:    Daily,
+			t:         time.Date(2026, 10, 18, 20, 0, 0, 0, time.UTC),
+			loc:       shanghai,
+			wantStart: time.Date(2026, 10, 19, 0, 0, 0, 0, shanghai),
+			wantEnd:   time.Date(2026, 10, 20, 0, 0, 0, 0, shanghai),
+			wantID:    "20261019",
+		},
+		{
+			name:      "按月",
+			period:    Monthly,
+			t:         time.Date(2026, 12, 31, 12, 0, 0, 0, time.UTC),
+			loc:       time.UTC,
+			wantStart: time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+			wantID:    "202612",
+		},
+		{
+			name:      "按月-时区",
+			period:    Monthly,
+			t:         time.Date(2026, 10, 31, 17, 0, 0, 0, time.UTC),
+			loc:       shanghai,
+			wantStart: time.Date(2026, 11, 1, 0, 0, 0, 0, shanghai),
+			wantEnd:   time.Date(2026, 12, 1, 0, 0, 0, 0, shanghai),
+			wantID:    "202611",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			start, end := tc.period.window(tc.t, tc.loc)
+			assert.True(t, tc.wantStart.Equal(start))
+			assert.True(t, tc.wantEnd.Equal(end))
+			assert.Equal(t, tc.wantID, tc.period.id(start))
+		})
+	}
+}
+
+func TestMemoryImplementation(t *testing.T) {
+	ServiceTest{
+		Name: "MemoryService",
+		NewService: func(t *testing.T, now func() time.Time) Service {
+			svc := NewMemoryService(Daily, 10, shanghai)
+			svc.now = now
+			return svc
+		},
+	}.RunTests(t)
+}
+
+func TestRedisImplementation(t *testing.T) {
+	ServiceTest{
+		Name: "RedisService",
+		NewService: func(t *testing.T, now func() time.Time) Service {
+			mr := miniredis.RunT(t)
+			client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			svc := NewRedisService(client, "quota:test", Daily, 10, shanghai)
+			svc.now = now
+			return svc
+		},
+	}.RunTests(t)
+}
@@ -0,0 +1,129 @@
+package quota
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+//go:embed consume.lua
+var luaConsume string
+
+var consumeScript = redis.NewScript(luaConsume)
+
+// retention 周期结束之后数据再保留一段时间，方便对账
+const retention = 24 * time.Hour
+
+var _ Service = (*RedisService)(nil)
+
+// RedisService 基于 Redis 的配额管理
+// 同一个周期内所有对象的用量放在一个 ZSET 里面，额外发放的配额放在一个 HASH 里面，
+// 两个 key 用周期作为 hash tag，保证在 Redis Cluster 上也能用 lua 脚本原子扣减
+type RedisService struct {
+	client redis.Cmdable
+	// key 前缀，例如 "quota:sms:daily"
+	prefix string
+	period Period
+	// 每个周期的基础配额
+	limit int64
+	// 对齐自然日、自然月使用的时区
+	loc *time.Location
+	now func() time.Time
+}
+
+// NewRedisService 创建一个配额管理服务，loc 为 nil 时使用 time.Local
+func NewRedisService(client redis.Cmdable, prefix string, period Period, limit int64, loc *time.Location) *RedisService {
+	if loc == nil {
+		loc = time.Local
+	}
+	return &RedisService{
+		client: client,
+		prefix: prefix,
+		period: period,
+		limit:  limit,
+		loc:    loc,
+		now:    time.Now,
+	}
+}
+
+func (r *RedisService) Consume(ctx context.Context, key string, n int64) (bool, error) {
+	if n <= 0 {
+		return false, ErrInvalidAmount
+	}
+	start, end := r.window()
+	ttl := end.Sub(r.now()) + retention
+	res, err := consumeScript.Run(ctx, r.client, []string{r.usedKey(start), r.grantedKey(start)},
+		key, n, r.limit, ttl.Milliseconds()).Int()
+	return res == 1, err
+}
+
+func (r *RedisService) Usage(ctx context.Context, key string) (Usage, error) {
+	start, end := r.window()
+	usage := Usage{Key: key, Start: start, End: end, Limit: r.limit}
+	used, err := r.client.ZScore(ctx, r.usedKey(start), key).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return Usage{}, err
+	}
+	granted, err := r.client.HGet(ctx, r.grantedKey(start), key).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return Usage{}, err
+	}
+	usage.Used = int64(used)
+	usage.Granted = granted
+	return usage, nil
+}
+
+func (r *RedisService) Grant(ctx context.Context, key string, n int64) error {
+	if n <= 0 {
+		return ErrInvalidAmount
+	}
+	start, end := r.window()
+	grantedKey := r.grantedKey(start)
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, grantedKey, key, n)
+		pipe.PExpire(ctx, grantedKey, end.Sub(r.now())+retention)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisService) Reset(ctx context.Context, key string) error {
+	start, _ := r.window()
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, r.usedKey(start), key)
+		pipe.HDel(ctx, r.grantedKey(start), key)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisService) TopConsumers(ctx context.Context, n int) ([]Consumer, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	start, _ := r.window()
+	zs, err := r.client.ZRevRangeWithScores(ctx, r.usedKey(start), 0, int64(n-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Consumer, 0, len(zs))
+	for _, z := range zs {
+		res = append(res, Consumer{Key: z.Member.(string), Used: int64(z.Score)})
+	}
+	return res, nil
+}
+
+func (r *RedisService) window() (time.Time, time.Time) {
+	return r.period.window(r.now(), r.loc)
+}
+
+func (r *RedisService) usedKey(start time.Time) string {
+	return r.prefix + ":{" + r.period.id(start) + "}:used"
+}
+
+func (r *RedisService) grantedKey(start time.Time) string {
+	return r.prefix + ":{" + r.period.id(start) + "}:granted"
+}
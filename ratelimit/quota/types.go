@@ -0,0 +1,51 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrInvalidAmount 配额数量必须大于 0
+var ErrInvalidAmount = errors.New("quota: 配额数量必须大于0")
+
+// Service 长周期（按天、按月）的配额管理
+// 周期按照配置的时区对齐到自然日、自然月
+type Service interface {
+	// Consume 在当前周期内消耗 n 个配额
+	// 返回 true 表示扣减成功，配额不足时返回 false，并且不会扣减
+	Consume(ctx context.Context, key string, n int64) (bool, error)
+	// Usage 查询当前周期的用量
+	Usage(ctx context.Context, key string) (Usage, error)
+	// Grant 在当前周期内额外发放 n 个配额，周期结束后失效
+	Grant(ctx context.Context, key string, n int64) error
+	// Reset 清空当前周期的用量和额外发放的配额
+	Reset(ctx context.Context, key string) error
+	// TopConsumers 当前周期内用量最多的 n 个对象，按照用量从高到低排序
+	TopConsumers(ctx context.Context, n int) ([]Consumer, error)
+}
+
+// Usage 某个对象在一个周期内的用量
+type Usage struct {
+	Key string
+	// 周期的起止时间，左闭右开
+	Start time.Time
+	End   time.Time
+	// 已经使用的配额
+	Used int64
+	// 基础配额
+	Limit int64
+	// 额外发放的配额
+	Granted int64
+}
+
+// Remaining 当前周期剩余的配额
+func (u Usage) Remaining() int64 {
+	return max(u.Limit+u.Granted-u.Used, 0)
+}
+
+// Consumer 用量排行中的一项
+type Consumer struct {
+	Key  string
+	Used int64
+}
@@ -2,6 +2,7 @@ package ratelimit
 
 import (
 	"context"
+	"crypto/rand"
 	_ "embed"
 	"time"
 
@@ -11,6 +12,19 @@ import (
 //go:embed slide_window.lua
 var luaSlideWindow string
 
+//go:embed slide_window_reserve.lua
+var luaSlideWindowReserve string
+
+// slideWindowScript 优先使用 EVALSHA，脚本不存在（NOSCRIPT）时回退到 EVAL
+var slideWindowScript = redis.NewScript(luaSlideWindow)
+
+var slideWindowReserveScript = redis.NewScript(luaSlideWindowReserve)
+
+var (
+	_ BlockingLimiter  = (*RedisSlidingWindowLimiter)(nil)
+	_ ThresholdLimiter = (*RedisSlidingWindowLimiter)(nil)
+)
+
 // RedisSlidingWindowLimiter Redis 上的滑动窗口算法限流器实现
 type RedisSlidingWindowLimiter struct {
 	cmd redis.Cmdable
@@ -19,16 +33,51 @@ type RedisSlidingWindowLimiter struct {
 	// 阈值
 	rate int
 	// interval 内允许 rate 个请求
+	opts redisOptions
 }
 
-func NewRedisSlidingWindowLimiter(cmd redis.Cmdable, interval time.Duration, rate int) Limiter {
+// NewRedisSlidingWindowLimiter rate 必须大于 0，否则会 panic
+func NewRedisSlidingWindowLimiter(cmd redis.Cmdable, interval time.Duration, rate int, opts ...Option) *RedisSlidingWindowLimiter {
+	if rate <= 0 {
+		panic("ratelimit: 滑动窗口的阈值必须大于 0")
+	}
 	return &RedisSlidingWindowLimiter{
 		cmd:      cmd,
 		interval: interval,
 		rate:     rate,
+		opts:     newRedisOptions(opts),
 	}
 }
 
 func (r *RedisSlidingWindowLimiter) Limit(ctx context.Context, key string) (bool, error) {
-	return r.cmd.Eval(ctx, luaSlideWindow, []string{key}, r.interval.Milliseconds(), r.rate, time.Now().UnixMilli()).Bool()
+	return r.limit(ctx, key, r.rate)
+}
+
+func (r *RedisSlidingWindowLimiter) LimitWithRatio(ctx context.Context, key string, ratio float64) (bool, error) {
+	return r.limit(ctx, key, ratioThreshold(r.rate, ratio))
+}
+
+func (r *RedisSlidingWindowLimiter) limit(ctx context.Context, key string, threshold int) (bool, error) {
+	return slideWindowScript.Run(ctx, r.cmd, []string{r.opts.key(key)},
+		r.interval.Milliseconds(), threshold, time.Now().UnixMilli(), rand.Text()).Bool()
+}
+
+func (r *RedisSlidingWindowLimiter) Wait(ctx context.Context, key string) error {
+	return wait(ctx, r, key)
+}
+
+func (r *RedisSlidingWindowLimiter) Reserve(ctx context.Context, key string) (Reservation, error) {
+	redisKey := r.opts.key(key)
+	member := rand.Text()
+	at, err := slideWindowReserveScript.Run(ctx, r.cmd, []string{redisKey},
+		r.interval.Milliseconds(), r.rate, time.Now().UnixMilli(), member).Int64()
+	if err != nil {
+		return Reservation{}, err
+	}
+	return Reservation{
+		at: time.UnixMilli(at),
+		cancel: func(ctx context.Context) error {
+			return r.cmd.ZRem(ctx, redisKey, member).Err()
+		},
+	}, nil
 }
@@ -0,0 +1,141 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisOptions_Key(t *testing.T) {
+	testCases := []struct {
+		name     string
+		opts     []Option
+		key      string
+		suffixes []string
+		want     string
+	}{
+		{
+			name: "默认不做处理",
+			key:  "sms:123",
+			want: "sms:123",
+		},
+		{
+			name: "前缀",
+			opts: []Option{WithKeyPrefix("ratelimit")},
+			key:  "sms:123",
+			want: "ratelimit:sms:123",
+		},
+		{
+			name: "前缀自带冒号",
+			opts: []Option{WithKeyPrefix("ratelimit:")},
+			key:  "sms:123",
+			want: "ratelimit:sms:123",
+		},
+		{
+			name: "hash tag",
+			opts: []Option{WithKeyPrefix("ratelimit"), WithHashTag()},
+			key:  "sms:123",
+			want: "ratelimit:{sms:123}",
+		},
+		{
+			name:     "多 key 后缀",
+			opts:     []Option{WithKeyPrefix("ratelimit"), WithHashTag()},
+			key:      "sms:123",
+			suffixes: []string{"local", "remote"},
+			want:     "ratelimit:{sms:123}:local:remote",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			o := newRedisOptions(tc.opts)
+			assert.Equal(t, tc.want, o.key(tc.key, tc.suffixes...))
+		})
+	}
+}
+
+func TestRedisSlidingWindowLimiter_Limit(t *testing.T) {
+	testCases := []struct {
+		name      string
+		newClient func(addr string) redis.Cmdable
+	}{
+		{
+			name: "单机",
+			newClient: func(addr string) redis.Cmdable {
+				return redis.NewClient(&redis.Options{Addr: addr})
+			},
+		},
+		{
+			name: "集群",
+			newClient: func(addr string) redis.Cmdable {
+				// miniredis 会把全部 slot 都分配给自己，可以充当本地的集群替身
+				return redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{addr}})
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			client := tc.newClient(mr.Addr())
+			ctx := t.Context()
+
+			limiter := NewRedisSlidingWindowLimiter(client, time.Minute, 1,
+				WithKeyPrefix("ratelimit"), WithHashTag())
+			limited, err := limiter.Limit(ctx, "sms:123")
+			require.NoError(t, err)
+			assert.False(t, limited)
+			limited, err = limiter.Limit(ctx, "sms:123")
+			require.NoError(t, err)
+			assert.True(t, limited)
+			assert.True(t, mr.Exists("ratelimit:{sms:123}"))
+
+			// 其它限流对象不受影响
+			limited, err = limiter.Limit(ctx, "sms:456")
+			require.NoError(t, err)
+			assert.False(t, limited)
+		})
+	}
+}
+
+func TestRedisSlidingWindowLimiter_NoScript(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := t.Context()
+
+	limiter := NewRedisSlidingWindowLimiter(client, time.Minute, 1)
+	limited, err := limiter.Limit(ctx, "key")
+	require.NoError(t, err)
+	assert.False(t, limited)
+
+	// 模拟 Redis 重启或者 SCRIPT FLUSH 之后脚本缓存丢失
+	require.NoError(t, client.ScriptFlush(ctx).Err())
+	limited, err = limiter.Limit(ctx, "key")
+	require.NoError(t, err)
+	assert.True(t, limited)
+
+	// 回退到 EVAL 之后脚本重新被缓存，后续可以继续走 EVALSHA
+	exists, err := client.ScriptExists(ctx, slideWindowScript.Hash()).Result()
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true}, exists)
+}
+
+func TestRedisSlidingWindowLimiter_SameMillisecond(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx := t.Context()
+
+	// 连续的请求大多落在同一毫秒内，每个请求都要单独计数
+	limiter := NewRedisSlidingWindowLimiter(client, time.Minute, 5)
+	passed := 0
+	for i := 0; i < 20; i++ {
+		limited, err := limiter.Limit(ctx, "key")
+		require.NoError(t, err)
+		if !limited {
+			passed++
+		}
+	}
+	assert.Equal(t, 5, passed)
+}
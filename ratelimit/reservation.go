@@ -0,0 +1,56 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Reservation 预约到的许可
+type Reservation struct {
+	at     time.Time
+	cancel func(ctx context.Context) error
+}
+
+// At 可以执行的时间
+func (r Reservation) At() time.Time {
+	return r.at
+}
+
+// Delay 还需要等待多久才能执行，0 表示可以立即执行
+func (r Reservation) Delay() time.Duration {
+	return max(time.Until(r.at), 0)
+}
+
+// Cancel 取消预约，把许可归还给限流器
+// 已经到了可以执行的时间的预约视为已经被使用，取消不会有任何效果
+func (r Reservation) Cancel(ctx context.Context) error {
+	if r.cancel == nil || !time.Now().Before(r.at) {
+		return nil
+	}
+	return r.cancel(ctx)
+}
+
+// wait 预约一个许可并等待到可以执行的时间，中途放弃等待时会归还许可
+func wait(ctx context.Context, l BlockingLimiter, key string) error {
+	r, err := l.Reserve(ctx, key)
+	if err != nil {
+		return err
+	}
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(r.at) {
+		_ = r.Cancel(context.WithoutCancel(ctx))
+		return ErrWaitExceedsDeadline
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		_ = r.Cancel(context.WithoutCancel(ctx))
+		return ctx.Err()
+	}
+}
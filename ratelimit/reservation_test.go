@@ -0,0 +1,123 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func blockingLimiterCases() []struct {
+	name       string
+	newLimiter func(t *testing.T, interval time.Duration, rate int) BlockingLimiter
+} {
+	return []struct {
+		name       string
+		newLimiter func(t *testing.T, interval time.Duration, rate int) BlockingLimiter
+	}{
+		{
+			name: "本地",
+			newLimiter: func(t *testing.T, interval time.Duration, rate int) BlockingLimiter {
+				return NewLocalSlidingWindowLimiter(interval, rate)
+			},
+		},
+		{
+			name: "Redis",
+			newLimiter: func(t *testing.T, interval time.Duration, rate int) BlockingLimiter {
+				mr := miniredis.RunT(t)
+				client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+				return NewRedisSlidingWindowLimiter(client, interval, rate)
+			},
+		},
+	}
+}
+
+func TestBlockingLimiter_Reserve(t *testing.T) {
+	for _, tc := range blockingLimiterCases() {
+		t.Run(tc.name, func(t *testing.T) {
+			l := tc.newLimiter(t, time.Minute, 1)
+			ctx := t.Context()
+
+			r1, err := l.Reserve(ctx, "key")
+			require.NoError(t, err)
+			assert.Equal(t, time.Duration(0), r1.Delay())
+
+			// 窗口已满，要等第一个许可滑出窗口
+			r2, err := l.Reserve(ctx, "key")
+			require.NoError(t, err)
+			assert.WithinDuration(t, r1.At().Add(time.Minute), r2.At(), time.Millisecond)
+			assert.Greater(t, r2.Delay(), 59*time.Second)
+
+			// 预约的许可也会占用窗口
+			limited, err := l.Limit(ctx, "key")
+			require.NoError(t, err)
+			assert.True(t, limited)
+
+			// 取消之后，后面的预约可以复用这个位置
+			require.NoError(t, r2.Cancel(ctx))
+			r3, err := l.Reserve(ctx, "key")
+			require.NoError(t, err)
+			assert.WithinDuration(t, r2.At(), r3.At(), time.Millisecond)
+		})
+	}
+}
+
+func TestBlockingLimiter_Wait(t *testing.T) {
+	for _, tc := range blockingLimiterCases() {
+		t.Run(tc.name, func(t *testing.T) {
+			l := tc.newLimiter(t, 50*time.Millisecond, 1)
+			ctx := t.Context()
+
+			require.NoError(t, l.Wait(ctx, "key"))
+			start := time.Now()
+			require.NoError(t, l.Wait(ctx, "key"))
+			assert.Greater(t, time.Since(start), 30*time.Millisecond)
+		})
+	}
+}
+
+func TestBlockingLimiter_WaitExceedsDeadline(t *testing.T) {
+	for _, tc := range blockingLimiterCases() {
+		t.Run(tc.name, func(t *testing.T) {
+			l := tc.newLimiter(t, time.Minute, 1)
+			require.NoError(t, l.Wait(t.Context(), "key"))
+
+			ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+			defer cancel()
+			assert.ErrorIs(t, l.Wait(ctx, "key"), ErrWaitExceedsDeadline)
+
+			// 放弃等待的许可已经被归还，预约到的时间不会被推后
+			r, err := l.Reserve(t.Context(), "key")
+			require.NoError(t, err)
+			assert.Less(t, r.Delay(), time.Minute+time.Millisecond)
+			assert.Greater(t, r.Delay(), 59*time.Second)
+		})
+	}
+}
+
+func TestBlockingLimiter_WaitCanceled(t *testing.T) {
+	for _, tc := range blockingLimiterCases() {
+		t.Run(tc.name, func(t *testing.T) {
+			l := tc.newLimiter(t, time.Minute, 1)
+			require.NoError(t, l.Wait(t.Context(), "key"))
+
+			ctx, cancel := context.WithCancel(t.Context())
+			time.AfterFunc(10*time.Millisecond, cancel)
+			assert.ErrorIs(t, l.Wait(ctx, "key"), context.Canceled)
+		})
+	}
+}
+
+func TestBlockingLimiter_InvalidRate(t *testing.T) {
+	for _, tc := range blockingLimiterCases() {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Panics(t, func() {
+				tc.newLimiter(t, time.Second, 0)
+			})
+		})
+	}
+}
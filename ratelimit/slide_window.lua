@@ -9,6 +9,8 @@ local window = tonumber(ARGV[1])
 -- 阈值
 local threshold = tonumber( ARGV[2])
 local now = tonumber(ARGV[3])
+-- 请求的唯一标识，避免同一毫秒内的多个请求被合并成一个
+local member = ARGV[4]
 -- 窗口的起始时间
 local min = now - window
 
@@ -19,8 +21,9 @@ if cnt >= threshold then
     -- 执行限流
     return "true"
 else
-    -- 把 score 和 member 都设置成 now
-    redis.call('ZADD', key, now, now)
-    redis.call('PEXPIRE', key, window)
+    redis.call('ZADD', key, now, member)
+    -- 窗口内可能有通过 Reserve 预约的未来的许可，过期时间要覆盖到最后一个许可
+    local last = redis.call('ZRANGE', key, -1, -1, 'WITHSCORES')
+    redis.call('PEXPIRE', key, math.max(tonumber(last[2]), now) - now + window)
     return "false"
 end
\ No newline at end of file
@@ -0,0 +1,23 @@
+-- 在滑动窗口上预约一个许可，返回可以执行的时间
+-- 限流对象
+local key = KEYS[1]
+-- 窗口大小
+local window = tonumber(ARGV[1])
+-- 阈值
+local threshold = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+-- 许可的唯一标识，取消预约时使用
+local member = ARGV[4]
+
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+local cnt = redis.call('ZCARD', key)
+local at = now
+if cnt >= threshold then
+    -- 窗口已满（可能包含未来的预约），要等到第 cnt-threshold+1 个许可滑出窗口才有空位
+    local entry = redis.call('ZRANGE', key, cnt - threshold, cnt - threshold, 'WITHSCORES')
+    at = tonumber(entry[2]) + window
+end
+redis.call('ZADD', key, at, member)
+-- 过期时间要覆盖到最后一个许可滑出窗口
+redis.call('PEXPIRE', key, at - now + window)
+return at
@@ -1,6 +1,12 @@
 package ratelimit
 
-import "context"
+import (
+	"context"
+	"errors"
+)
+
+// ErrWaitExceedsDeadline 等待许可的时间超过了 ctx 的截止时间
+var ErrWaitExceedsDeadline = errors.New("ratelimit: 等待许可的时间超过了 ctx 的截止时间")
 
 type Limiter interface {
 	// Limit 有没有触发限流，key 就是限流对象
@@ -8,3 +14,14 @@ type Limiter interface {
 	// err 限流器本身有没有错误
 	Limit(ctx context.Context, key string) (bool, error)
 }
+
+// BlockingLimiter 支持等待许可的限流器，适合后台任务、消费者这种不希望直接被拒绝的场景
+type BlockingLimiter interface {
+	Limiter
+	// Wait 阻塞直到拿到许可
+	// 如果 ctx 的截止时间早于可以拿到许可的时间，会立刻返回 ErrWaitExceedsDeadline
+	Wait(ctx context.Context, key string) error
+	// Reserve 预约一个许可，调用者需要在 Reservation.At 之后再执行
+	// 不再需要的时候调用 Reservation.Cancel 归还许可
+	Reserve(ctx context.Context, key string) (Reservation, error)
+}
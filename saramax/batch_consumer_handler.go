@@ -2,28 +2,67 @@ package saramax
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/IBM/sarama"
+	"github.com/rermrf/emo/batchsize"
 	"github.com/rermrf/emo/logger"
+	"github.com/rermrf/emo/retry/strategy"
+	"github.com/rermrf/emo/slice"
 )
 
+// ErrUnprocessed 有消息处理失败，并且没有被死信队列接收
+// ConsumeClaim 会在这条消息之前停下来，之后的消息都不会被标记。
+// ConsumeClaim 返回错误之后 sarama 会取消整个 session，这个消费者上的所有分区都会停下来，
+// 重新加入消费者组之后从这条消息开始消费。如果失败是持续的，例如消息本身有问题，
+// 每次重新加入都会在同一条消息上失败，反复触发重平衡，所以需要配置可用的死信队列，或者在业务里面兜底
+var ErrUnprocessed = errors.New("saramax: 消息处理失败")
+
 // BatchHandler 批量消费接口
 type BatchHandler[T any] struct {
-	l  logger.Logger
-	fn func(msgs []*sarama.ConsumerMessage, t []T) error
-	// 用 option 模式来设置
+	l logger.Logger
+	// 返回每条消息的处理结果，nil 表示处理成功
+	fn            func(ctx context.Context, msgs []*sarama.ConsumerMessage, t []T) []error
 	batchSize     int
 	batchDuration time.Duration
+	// 为 nil 的时候每一批的大小固定是 batchSize
+	adjuster   batchsize.Adjuster
+	codecs     codecs
+	deadLetter DeadLetterSink
+	// 每一批消息创建一个新的重试策略
+	retryStrategy func() strategy.Strategy
+}
+
+// NewBatchHandler fn 返回错误的时候整批消息都当作处理失败
+// fn 收到的 ctx 是 session.Context()，重平衡或者消费者关闭的时候会被取消
+func NewBatchHandler[T any](l logger.Logger, fn func(ctx context.Context, msgs []*sarama.ConsumerMessage, t []T) error, opts ...Option) *BatchHandler[T] {
+	return NewBatchResultHandler[T](l, func(ctx context.Context, msgs []*sarama.ConsumerMessage, ts []T) []error {
+		errs := make([]error, len(msgs))
+		if err := fn(ctx, msgs, ts); err != nil {
+			for i := range errs {
+				errs[i] = err
+			}
+		}
+		return errs
+	}, opts...)
 }
 
-func NewBatchHandler[T any](l logger.Logger, fn func(msgs []*sarama.ConsumerMessage, t []T) error) *BatchHandler[T] {
+// NewBatchResultHandler fn 返回每条消息的处理结果，长度要和 msgs 一致，nil 表示处理成功
+// 处理成功的消息会被标记，失败的消息按照重试策略单独重试，
+// 重试用完之后交给死信队列，死信队列也没有接收的时候 ConsumeClaim 返回 ErrUnprocessed
+func NewBatchResultHandler[T any](l logger.Logger, fn func(ctx context.Context, msgs []*sarama.ConsumerMessage, t []T) []error, opts ...Option) *BatchHandler[T] {
+	o := newOptions(opts)
 	return &BatchHandler[T]{
 		l:             l,
 		fn:            fn,
-		batchSize:     10,
-		batchDuration: time.Second,
+		batchSize:     o.batchSize,
+		batchDuration: o.batchDuration,
+		adjuster:      o.adjuster,
+		codecs:        o.codecs,
+		deadLetter:    o.deadLetter,
+		retryStrategy: o.retryStrategy,
 	}
 }
 
@@ -39,11 +78,11 @@ func (b *BatchHandler[T]) ConsumeClaim(session sarama.ConsumerGroupSession, clai
 	// 批量消费
 	msgsCh := claim.Messages()
 	batchSize := b.batchSize
-	ctx, cancel := context.WithTimeout(context.Background(), b.batchDuration)
 	for {
+		// 每一批都重新计时，消费者关闭的时候也不用等到超时
+		ctx, cancel := context.WithTimeout(session.Context(), b.batchDuration)
 		done := false
 		msgs := make([]*sarama.ConsumerMessage, 0, batchSize)
-		ts := make([]T, 0, batchSize)
 		for i := 0; i < batchSize && !done; i++ {
 			select {
 			case <-ctx.Done():
@@ -55,33 +94,167 @@ func (b *BatchHandler[T]) ConsumeClaim(session sarama.ConsumerGroupSession, clai
 					// 消费者被关闭
 					return nil
 				}
-				var t T
-				err := json.Unmarshal(msg.Value, &t)
-				if err != nil {
-					b.l.Error("反序列化失败",
-						logger.Error(err),
-						logger.String("topic", msg.Topic),
-						logger.Int32("partition", msg.Partition),
-						logger.Int64("offset", msg.Offset))
-					continue
-				}
 				msgs = append(msgs, msg)
-				ts = append(ts, t)
 			}
 		}
 		cancel()
+		if session.Context().Err() != nil {
+			// 重平衡或者消费者被关闭，还没处理的消息交给下一个消费者
+			return nil
+		}
 		if len(msgs) == 0 {
 			continue
 		}
-		err := b.fn(msgs, ts)
-		if err != nil {
-			b.l.Error("调用业务批量接口失败",
-				logger.Error(err))
-
-			// 还要继续消费
+		// 每条消息的结果和执行次数，反序列化失败的消息也在里面，执行次数是 0，
+		// 这样它们和业务处理失败的消息一起按照 offset 的顺序标记
+		errs := make([]error, len(msgs))
+		attempts := make([]int, len(msgs))
+		decoded, ts := b.decode(msgs, errs)
+		var elapsed time.Duration
+		if len(decoded) > 0 {
+			var res []error
+			var n int
+			res, n, elapsed = b.process(session.Context(), slice.Map(decoded, func(_ int, idx int) *sarama.ConsumerMessage {
+				return msgs[idx]
+			}), ts)
+			for i, idx := range decoded {
+				errs[idx] = res[i]
+				attempts[idx] = n
+			}
 		}
-		for _, msg := range msgs {
+		if session.Context().Err() != nil {
+			// 重平衡或者消费者被关闭，标记第一条失败的消息之前已经处理成功的消息，其它的交给下一个消费者
+			for i, msg := range msgs {
+				if errs[i] != nil {
+					break
+				}
+				session.MarkMessage(msg, "")
+			}
+			return nil
+		}
+		if len(decoded) > 0 {
+			batchSize = b.nextBatchSize(session.Context(), batchSize, elapsed)
+		}
+		// 按照 offset 的顺序标记，遇到没有处理的消息就停下来，避免提交的 offset 越过它
+		for i, msg := range msgs {
+			if errs[i] == nil {
+				session.MarkMessage(msg, "")
+				continue
+			}
+			if !b.sendDeadLetter(session, msg, attempts[i], errs[i]) {
+				b.l.Error("消息处理失败，停止消费这个分区",
+					logger.Error(errs[i]),
+					logger.String("topic", msg.Topic),
+					logger.Int32("partition", msg.Partition),
+					logger.Int64("offset", msg.Offset))
+				return fmt.Errorf("%w: topic %s partition %d offset %d: %w",
+					ErrUnprocessed, msg.Topic, msg.Partition, msg.Offset, errs[i])
+			}
 			session.MarkMessage(msg, "")
 		}
 	}
 }
+
+// decode 反序列化这一批消息，失败的消息结果写到 errs 里面，返回反序列化成功的消息的下标和结果
+func (b *BatchHandler[T]) decode(msgs []*sarama.ConsumerMessage, errs []error) ([]int, []T) {
+	decoded := make([]int, 0, len(msgs))
+	ts := make([]T, 0, len(msgs))
+	for i, msg := range msgs {
+		var t T
+		if err := b.codecs.decode(msg, &t); err != nil {
+			b.l.Error("反序列化失败",
+				logger.Error(err),
+				logger.String("topic", msg.Topic),
+				logger.Int32("partition", msg.Partition),
+				logger.Int64("offset", msg.Offset))
+			// 反序列化失败重试也没有用，直接当作处理失败
+			errs[i] = err
+			continue
+		}
+		decoded = append(decoded, i)
+		ts = append(ts, t)
+	}
+	return decoded, ts
+}
+
+// process 处理一批消息，失败的消息按照重试策略重试，成功的不会被重复处理
+// 返回每条消息最终的结果、执行的次数和第一次处理整批消息的时间
+func (b *BatchHandler[T]) process(ctx context.Context, msgs []*sarama.ConsumerMessage, ts []T) ([]error, int, time.Duration) {
+	errs := make([]error, len(msgs))
+	pending := make([]int, len(msgs))
+	for i := range pending {
+		pending[i] = i
+	}
+	var elapsed time.Duration
+	attempts, _ := retry(ctx, b.retryStrategy, func() error {
+		pendingMsgs := slice.Map(pending, func(_ int, idx int) *sarama.ConsumerMessage {
+			return msgs[idx]
+		})
+		pendingTs := slice.Map(pending, func(_ int, idx int) T {
+			return ts[idx]
+		})
+		start := time.Now()
+		res := b.fn(ctx, pendingMsgs, pendingTs)
+		if elapsed == 0 {
+			elapsed = time.Since(start)
+		}
+		if len(res) != len(pending) {
+			err := fmt.Errorf("saramax: 批量接口返回了 %d 个结果，预期是 %d 个", len(res), len(pending))
+			res = make([]error, len(pending))
+			for i := range res {
+				res[i] = err
+			}
+		}
+		failed := make([]int, 0, len(pending))
+		var firstErr error
+		for i, idx := range pending {
+			errs[idx] = res[i]
+			if res[i] != nil {
+				failed = append(failed, idx)
+				if firstErr == nil {
+					firstErr = res[i]
+				}
+			}
+		}
+		pending = failed
+		if firstErr != nil {
+			b.l.Error("调用业务批量接口失败",
+				logger.Error(firstErr),
+				logger.Int64("failed", int64(len(failed))))
+		}
+		return firstErr
+	})
+	return errs, attempts, elapsed
+}
+
+// nextBatchSize 根据这一批的处理时间计算下一批的大小，出错的时候保持不变
+func (b *BatchHandler[T]) nextBatchSize(ctx context.Context, current int, elapsed time.Duration) int {
+	if b.adjuster == nil {
+		return current
+	}
+	size, err := b.adjuster.Adjust(ctx, elapsed)
+	if err != nil || size <= 0 {
+		b.l.Warn("调整批次大小失败",
+			logger.Error(err),
+			logger.Int64("size", int64(size)))
+		return current
+	}
+	return size
+}
+
+// sendDeadLetter 返回消息是否被死信队列接收，由调用者按照 offset 的顺序标记
+func (b *BatchHandler[T]) sendDeadLetter(session sarama.ConsumerGroupSession, msg *sarama.ConsumerMessage, attempts int, cause error) bool {
+	if b.deadLetter == nil {
+		return false
+	}
+	err := b.deadLetter.Send(session.Context(), msg, attempts, cause)
+	if err != nil {
+		b.l.Error("发送死信消息失败",
+			logger.Error(err),
+			logger.String("topic", msg.Topic),
+			logger.Int32("partition", msg.Partition),
+			logger.Int64("offset", msg.Offset))
+		return false
+	}
+	return true
+}
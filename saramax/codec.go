@@ -0,0 +1,136 @@
+package saramax
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/IBM/sarama"
+	"google.golang.org/protobuf/proto"
+)
+
+// HeaderContentType 消息里面标识编码方式的 header
+const HeaderContentType = "content-type"
+
+// Codec 消息的编解码方式
+type Codec interface {
+	// ContentType 写到 content-type header 里面的值，也用来根据 header 选择 Codec
+	ContentType() string
+	Encode(v any) ([]byte, error)
+	// Decode v 是指向目标的指针
+	Decode(data []byte, v any) error
+}
+
+var (
+	_ Codec = JSONCodec{}
+	_ Codec = ProtobufCodec{}
+	_ Codec = RawCodec{}
+)
+
+// JSONCodec 默认的编码方式
+type JSONCodec struct{}
+
+func (JSONCodec) ContentType() string {
+	return "application/json"
+}
+
+func (JSONCodec) Encode(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Decode(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// ProtobufCodec 消息类型需要是 proto.Message，例如 Handler[*pb.User]
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) ContentType() string {
+	return "application/x-protobuf"
+}
+
+func (ProtobufCodec) Encode(v any) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("saramax: %T 不是 proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (ProtobufCodec) Decode(data []byte, v any) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+	// Handler[*pb.User] 解码的时候传进来的是 **pb.User，需要先创建 pb.User
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer && rv.Elem().Kind() == reflect.Pointer {
+		elem := reflect.New(rv.Elem().Type().Elem())
+		if m, ok := elem.Interface().(proto.Message); ok {
+			if err := proto.Unmarshal(data, m); err != nil {
+				return err
+			}
+			rv.Elem().Set(elem)
+			return nil
+		}
+	}
+	return fmt.Errorf("saramax: %T 不是 proto.Message", v)
+}
+
+// RawCodec 不做任何转换，消息类型需要是 []byte 或者 string
+type RawCodec struct{}
+
+func (RawCodec) ContentType() string {
+	return "application/octet-stream"
+}
+
+func (RawCodec) Encode(v any) ([]byte, error) {
+	switch val := v.(type) {
+	case []byte:
+		return val, nil
+	case string:
+		return []byte(val), nil
+	default:
+		return nil, fmt.Errorf("saramax: RawCodec 不支持 %T", v)
+	}
+}
+
+func (RawCodec) Decode(data []byte, v any) error {
+	switch val := v.(type) {
+	case *[]byte:
+		*val = data
+	case *string:
+		*val = string(data)
+	default:
+		return fmt.Errorf("saramax: RawCodec 不支持 %T", v)
+	}
+	return nil
+}
+
+// codecs 根据 content-type header 选择 Codec，没有 header 或者不认识的时候使用默认的
+type codecs struct {
+	defaultCodec Codec
+	byType       map[string]Codec
+}
+
+func newCodecs() codecs {
+	return codecs{
+		defaultCodec: JSONCodec{},
+		byType:       make(map[string]Codec),
+	}
+}
+
+func (c codecs) codec(headers []*sarama.RecordHeader) Codec {
+	if len(c.byType) == 0 {
+		return c.defaultCodec
+	}
+	if contentType, ok := HeaderValue(headers, HeaderContentType); ok {
+		if codec, ok := c.byType[contentType]; ok {
+			return codec
+		}
+	}
+	return c.defaultCodec
+}
+
+func (c codecs) decode(msg *sarama.ConsumerMessage, v any) error {
+	return c.codec(msg.Headers).Decode(msg.Value, v)
+}
@@ -0,0 +1,88 @@
+package saramax
+
+import (
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestProtobufCodec(t *testing.T) {
+	codec := ProtobufCodec{}
+	data, err := codec.Encode(wrapperspb.String("hello"))
+	require.NoError(t, err)
+
+	// Handler[*wrapperspb.StringValue] 传进来的是 **wrapperspb.StringValue
+	var ptr *wrapperspb.StringValue
+	require.NoError(t, codec.Decode(data, &ptr))
+	assert.Equal(t, "hello", ptr.GetValue())
+
+	var msg wrapperspb.StringValue
+	require.NoError(t, codec.Decode(data, &msg))
+	assert.True(t, proto.Equal(wrapperspb.String("hello"), &msg))
+
+	_, err = codec.Encode("hello")
+	assert.Error(t, err)
+	var s string
+	assert.Error(t, codec.Decode(data, &s))
+}
+
+func TestRawCodec(t *testing.T) {
+	codec := RawCodec{}
+	data, err := codec.Encode("hello")
+	require.NoError(t, err)
+	var s string
+	require.NoError(t, codec.Decode(data, &s))
+	assert.Equal(t, "hello", s)
+	var b []byte
+	require.NoError(t, codec.Decode(data, &b))
+	assert.Equal(t, []byte("hello"), b)
+
+	_, err = codec.Encode(1)
+	assert.Error(t, err)
+	var i int
+	assert.Error(t, codec.Decode(data, &i))
+}
+
+func TestCodecs_ContentType(t *testing.T) {
+	o := newOptions([]Option{WithContentTypeCodecs(RawCodec{}, JSONCodec{})})
+	testCases := []struct {
+		name    string
+		headers []*sarama.RecordHeader
+		want    Codec
+	}{
+		{
+			name: "没有 header 使用默认的",
+			want: JSONCodec{},
+		},
+		{
+			name: "根据 header 选择",
+			headers: []*sarama.RecordHeader{
+				{Key: []byte("Content-Type"), Value: []byte("application/octet-stream")},
+			},
+			want: RawCodec{},
+		},
+		{
+			name: "不认识的 header 使用默认的",
+			headers: []*sarama.RecordHeader{
+				{Key: []byte(HeaderContentType), Value: []byte("text/xml")},
+			},
+			want: JSONCodec{},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, o.codecs.codec(tc.headers))
+		})
+	}
+
+	var s string
+	require.NoError(t, o.codecs.decode(&sarama.ConsumerMessage{
+		Headers: []*sarama.RecordHeader{{Key: []byte(HeaderContentType), Value: []byte("application/octet-stream")}},
+		Value:   []byte("raw"),
+	}, &s))
+	assert.Equal(t, "raw", s)
+}
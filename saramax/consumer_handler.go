@@ -1,21 +1,31 @@
 package saramax
 
 import (
-	"encoding/json"
+	"context"
 
 	"github.com/IBM/sarama"
 	"github.com/rermrf/emo/logger"
+	"github.com/rermrf/emo/retry/strategy"
 )
 
 type Handler[T any] struct {
-	l  logger.Logger
-	fn func(msg *sarama.ConsumerMessage, t T) error
+	l          logger.Logger
+	fn         func(ctx context.Context, msg *sarama.ConsumerMessage, t T) error
+	codecs     codecs
+	deadLetter DeadLetterSink
+	// 每条消息创建一个新的重试策略
+	retryStrategy func() strategy.Strategy
 }
 
-func NewHandler[T any](l logger.Logger, fn func(msg *sarama.ConsumerMessage, t T) error) *Handler[T] {
+// NewHandler fn 收到的 ctx 是 session.Context()，重平衡或者消费者关闭的时候会被取消
+func NewHandler[T any](l logger.Logger, fn func(ctx context.Context, msg *sarama.ConsumerMessage, t T) error, opts ...Option) *Handler[T] {
+	o := newOptions(opts)
 	return &Handler[T]{
-		l:  l,
-		fn: fn,
+		l:             l,
+		fn:            fn,
+		codecs:        o.codecs,
+		deadLetter:    o.deadLetter,
+		retryStrategy: o.retryStrategy,
 	}
 }
 
@@ -31,7 +41,7 @@ func (h Handler[T]) ConsumeClaim(session sarama.ConsumerGroupSession, claim sara
 	msgs := claim.Messages()
 	for msg := range msgs {
 		var t T
-		err := json.Unmarshal(msg.Value, &t)
+		err := h.codecs.decode(msg, &t)
 		if err != nil {
 			// 打日志
 			h.l.Error("反序列化消息失败",
@@ -40,22 +50,28 @@ func (h Handler[T]) ConsumeClaim(session sarama.ConsumerGroupSession, claim sara
 				logger.Int32("partition", msg.Partition),
 				logger.Int64("offset", msg.Offset),
 			)
+			h.sendDeadLetter(session, msg, 0, err)
 			continue
 		}
-		//err = h.fn(msg, t)
-
 		// 在这里执行重试
-		for i := 0; i < 3; i++ {
-			err = h.fn(msg, t)
-			if err == nil {
-				break
+		attempts, err := retry(session.Context(), h.retryStrategy, func() error {
+			err := h.fn(session.Context(), msg, t)
+			if err != nil {
+				h.l.Error("处理消息失败",
+					logger.Error(err),
+					logger.String("topic", msg.Topic),
+					logger.Int32("partition", msg.Partition),
+					logger.Int64("offset", msg.Offset),
+				)
 			}
-			h.l.Error("处理消息失败",
-				logger.Error(err),
-				logger.String("topic", msg.Topic),
-				logger.Int32("partition", msg.Partition),
-				logger.Int64("offset", msg.Offset),
-			)
+			return err
+		})
+		if err == nil {
+			session.MarkMessage(msg, "")
+		}
+		if session.Context().Err() != nil {
+			// 重平衡或者消费者被关闭，处理失败的消息不标记，交给下一个消费者处理
+			return nil
 		}
 
 		if err != nil {
@@ -65,9 +81,26 @@ func (h Handler[T]) ConsumeClaim(session sarama.ConsumerGroupSession, claim sara
 				logger.Int32("partition", msg.Partition),
 				logger.Int64("offset", msg.Offset),
 			)
-		} else {
-			session.MarkMessage(msg, "")
+			h.sendDeadLetter(session, msg, attempts, err)
 		}
 	}
 	return nil
 }
+
+// sendDeadLetter 发送到死信队列成功之后标记消息
+func (h Handler[T]) sendDeadLetter(session sarama.ConsumerGroupSession, msg *sarama.ConsumerMessage, attempts int, cause error) {
+	if h.deadLetter == nil {
+		return
+	}
+	err := h.deadLetter.Send(session.Context(), msg, attempts, cause)
+	if err != nil {
+		h.l.Error("发送死信消息失败",
+			logger.Error(err),
+			logger.String("topic", msg.Topic),
+			logger.Int32("partition", msg.Partition),
+			logger.Int64("offset", msg.Offset),
+		)
+		return
+	}
+	session.MarkMessage(msg, "")
+}
@@ -0,0 +1,71 @@
+package saramax
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/IBM/sarama"
+)
+
+// 死信消息上记录失败原因和原始位置的 header
+const (
+	HeaderDeadLetterError             = "x-dlq-error"
+	HeaderDeadLetterAttempts          = "x-dlq-attempts"
+	HeaderDeadLetterOriginalTopic     = "x-dlq-original-topic"
+	HeaderDeadLetterOriginalPartition = "x-dlq-original-partition"
+	HeaderDeadLetterOriginalOffset    = "x-dlq-original-offset"
+	// HeaderDeadLetterOriginalTimestamp 原始消息的时间戳，毫秒
+	HeaderDeadLetterOriginalTimestamp = "x-dlq-original-timestamp"
+)
+
+// DeadLetterSink 接收处理失败的消息，返回 nil 之后原始消息会被标记为已经消费
+type DeadLetterSink interface {
+	// Send attempts 是已经处理的次数，反序列化失败的时候是 0
+	Send(ctx context.Context, msg *sarama.ConsumerMessage, attempts int, cause error) error
+}
+
+var _ DeadLetterSink = (*DeadLetterProducer)(nil)
+
+// DeadLetterProducer 把原始消息原样发送到死信 topic，并且带上失败原因和原始位置的 header
+type DeadLetterProducer struct {
+	producer sarama.SyncProducer
+	topic    string
+}
+
+func NewDeadLetterProducer(producer sarama.SyncProducer, topic string) *DeadLetterProducer {
+	return &DeadLetterProducer{
+		producer: producer,
+		topic:    topic,
+	}
+}
+
+func (d *DeadLetterProducer) Send(ctx context.Context, msg *sarama.ConsumerMessage, attempts int, cause error) error {
+	headers := make([]sarama.RecordHeader, 0, len(msg.Headers)+6)
+	for _, h := range msg.Headers {
+		if h != nil {
+			headers = append(headers, *h)
+		}
+	}
+	errMsg := ""
+	if cause != nil {
+		errMsg = cause.Error()
+	}
+	headers = append(headers,
+		Header(HeaderDeadLetterError, errMsg),
+		Header(HeaderDeadLetterAttempts, strconv.Itoa(attempts)),
+		Header(HeaderDeadLetterOriginalTopic, msg.Topic),
+		Header(HeaderDeadLetterOriginalPartition, strconv.FormatInt(int64(msg.Partition), 10)),
+		Header(HeaderDeadLetterOriginalOffset, strconv.FormatInt(msg.Offset, 10)),
+		Header(HeaderDeadLetterOriginalTimestamp, strconv.FormatInt(msg.Timestamp.UnixMilli(), 10)),
+	)
+	pm := &sarama.ProducerMessage{
+		Topic:   d.topic,
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: headers,
+	}
+	if msg.Key != nil {
+		pm.Key = sarama.ByteEncoder(msg.Key)
+	}
+	_, _, err := d.producer.SendMessage(pm)
+	return err
+}
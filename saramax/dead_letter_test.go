@@ -0,0 +1,58 @@
+package saramax
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetterProducer_Send(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	t.Cleanup(func() {
+		_ = producer.Close()
+	})
+	var sent *sarama.ProducerMessage
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		sent = msg
+		return nil
+	})
+
+	dlq := NewDeadLetterProducer(producer, "orders.dlq")
+	err := dlq.Send(t.Context(), &sarama.ConsumerMessage{
+		Topic:     "orders",
+		Partition: 2,
+		Offset:    42,
+		Key:       []byte("order-1"),
+		Value:     []byte(`{"id":1}`),
+		Timestamp: time.UnixMilli(1700000000000),
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte(HeaderContentType), Value: []byte("application/json")},
+		},
+	}, 3, errors.New("mock error"))
+	require.NoError(t, err)
+
+	require.NotNil(t, sent)
+	assert.Equal(t, "orders.dlq", sent.Topic)
+	key, _ := sent.Key.Encode()
+	assert.Equal(t, []byte("order-1"), key)
+	val, _ := sent.Value.Encode()
+	assert.Equal(t, []byte(`{"id":1}`), val)
+	headers := make(map[string]string, len(sent.Headers))
+	for _, h := range sent.Headers {
+		headers[string(h.Key)] = string(h.Value)
+	}
+	assert.Equal(t, map[string]string{
+		HeaderContentType:                 "application/json",
+		HeaderDeadLetterError:             "mock error",
+		HeaderDeadLetterAttempts:          "3",
+		HeaderDeadLetterOriginalTopic:     "orders",
+		HeaderDeadLetterOriginalPartition: "2",
+		HeaderDeadLetterOriginalOffset:    "42",
+		HeaderDeadLetterOriginalTimestamp: "1700000000000",
+	}, headers)
+}
@@ -0,0 +1,528 @@
+package saramax
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/rermrf/emo/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSession 记录被标记的消息
+type fakeSession struct {
+	ctx    context.Context
+	mu     sync.Mutex
+	marked []int64
+}
+
+func newFakeSession(ctx context.Context) *fakeSession {
+	return &fakeSession{ctx: ctx}
+}
+
+func (s *fakeSession) Claims() map[string][]int32 {
+	return nil
+}
+
+func (s *fakeSession) MemberID() string {
+	return "member"
+}
+
+func (s *fakeSession) GenerationID() int32 {
+	return 1
+}
+
+func (s *fakeSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {}
+
+func (s *fakeSession) Commit() {}
+
+func (s *fakeSession) ResetOffset(topic string, partition int32, offset int64, metadata string) {}
+
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.marked = append(s.marked, msg.Offset)
+}
+
+func (s *fakeSession) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeSession) Marked() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int64(nil), s.marked...)
+}
+
+// fakeClaim 把 values 依次作为 offset 从 0 开始的消息发出去
+type fakeClaim struct {
+	msgs   chan *sarama.ConsumerMessage
+	offset int64
+}
+
+// newFakeClaim 一次性发出所有的消息，然后关闭
+func newFakeClaim(values ...string) *fakeClaim {
+	c := &fakeClaim{msgs: make(chan *sarama.ConsumerMessage, len(values))}
+	c.send(values...)
+	close(c.msgs)
+	return c
+}
+
+func (c *fakeClaim) send(values ...string) {
+	for _, val := range values {
+		c.msgs <- &sarama.ConsumerMessage{
+			Topic:  "test",
+			Offset: c.offset,
+			Value:  []byte(val),
+		}
+		c.offset++
+	}
+}
+
+func (c *fakeClaim) Topic() string {
+	return "test"
+}
+
+func (c *fakeClaim) Partition() int32 {
+	return 0
+}
+
+func (c *fakeClaim) InitialOffset() int64 {
+	return 0
+}
+
+func (c *fakeClaim) HighWaterMarkOffset() int64 {
+	return int64(cap(c.msgs))
+}
+
+func (c *fakeClaim) Messages() <-chan *sarama.ConsumerMessage {
+	return c.msgs
+}
+
+// fixedSizes 依次返回 sizes，记录每次的处理时间
+type fixedSizes struct {
+	sizes []int
+	calls int
+}
+
+func (f *fixedSizes) Adjust(ctx context.Context, responseTime time.Duration) (int, error) {
+	size := f.sizes[f.calls]
+	f.calls++
+	return size, nil
+}
+
+func TestBatchOptions_Invalid(t *testing.T) {
+	testCases := []struct {
+		name         string
+		opts         []Option
+		wantSize     int
+		wantDuration time.Duration
+	}{
+		{
+			name:         "合法的值",
+			opts:         []Option{WithBatchSize(5), WithBatchDuration(time.Minute)},
+			wantSize:     5,
+			wantDuration: time.Minute,
+		},
+		{
+			name:         "0 使用默认值",
+			opts:         []Option{WithBatchSize(0), WithBatchDuration(0)},
+			wantSize:     10,
+			wantDuration: time.Second,
+		},
+		{
+			name:         "负数使用默认值",
+			opts:         []Option{WithBatchSize(-1), WithBatchDuration(-time.Second)},
+			wantSize:     10,
+			wantDuration: time.Second,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			o := newOptions(tc.opts)
+			assert.Equal(t, tc.wantSize, o.batchSize)
+			assert.Equal(t, tc.wantDuration, o.batchDuration)
+		})
+	}
+}
+
+func TestBatchHandler_NextBatchSize(t *testing.T) {
+	adjuster := &fixedSizes{sizes: []int{3, 0, 1}}
+	h := NewBatchHandler[string](logger.NewNopLogger(), func(ctx context.Context, msgs []*sarama.ConsumerMessage, ts []string) error {
+		return nil
+	}, WithBatchSize(2), WithBatchSizeAdjuster(adjuster))
+	ctx := t.Context()
+
+	size := h.nextBatchSize(ctx, h.batchSize, time.Millisecond)
+	assert.Equal(t, 3, size)
+	// adjuster 返回非法的大小的时候保持不变
+	size = h.nextBatchSize(ctx, size, time.Millisecond)
+	assert.Equal(t, 3, size)
+	size = h.nextBatchSize(ctx, size, time.Millisecond)
+	assert.Equal(t, 1, size)
+
+	// 没有 adjuster 的时候每一批的大小固定
+	h = NewBatchHandler[string](logger.NewNopLogger(), func(ctx context.Context, msgs []*sarama.ConsumerMessage, ts []string) error {
+		return nil
+	}, WithBatchSize(2))
+	assert.Equal(t, 2, h.nextBatchSize(ctx, h.batchSize, time.Millisecond))
+}
+
+func TestBatchHandler_Adjuster(t *testing.T) {
+	var batches [][]string
+	adjuster := &fixedSizes{sizes: []int{3, 1, 1}}
+	h := NewBatchHandler[string](logger.NewNopLogger(), func(ctx context.Context, msgs []*sarama.ConsumerMessage, ts []string) error {
+		batches = append(batches, ts)
+		return nil
+	}, WithCodec(RawCodec{}), WithBatchSize(2), WithBatchDuration(time.Second), WithBatchSizeAdjuster(adjuster))
+
+	session := newFakeSession(t.Context())
+	err := h.ConsumeClaim(session, newFakeClaim("a", "b", "c", "d", "e", "f"))
+	require.NoError(t, err)
+	// 第一批使用 WithBatchSize，之后使用 adjuster 返回的大小
+	assert.Equal(t, [][]string{{"a", "b"}, {"c", "d", "e"}, {"f"}}, batches)
+	assert.Equal(t, []int64{0, 1, 2, 3, 4, 5}, session.Marked())
+	assert.Equal(t, 3, adjuster.calls)
+}
+
+// fakeSink 记录死信消息
+type fakeSink struct {
+	err      error
+	offsets  []int64
+	attempts []int
+}
+
+func (s *fakeSink) Send(ctx context.Context, msg *sarama.ConsumerMessage, attempts int, cause error) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.offsets = append(s.offsets, msg.Offset)
+	s.attempts = append(s.attempts, attempts)
+	return nil
+}
+
+func TestBatchResultHandler(t *testing.T) {
+	errMock := errors.New("mock error")
+	testCases := []struct {
+		name string
+		// 每个值失败的次数
+		failures   map[string]int
+		deadLetter *fakeSink
+
+		wantCalls      [][]string
+		wantMarked     []int64
+		wantDeadLetter []int64
+		wantErr        error
+	}{
+		{
+			name:       "全部成功",
+			wantCalls:  [][]string{{"a", "b", "c"}},
+			wantMarked: []int64{0, 1, 2},
+		},
+		{
+			name:       "只重试失败的消息",
+			failures:   map[string]int{"b": 1},
+			wantCalls:  [][]string{{"a", "b", "c"}, {"b"}},
+			wantMarked: []int64{0, 1, 2},
+		},
+		{
+			name:       "重试用完之后停在失败的消息之前",
+			failures:   map[string]int{"b": 3},
+			wantCalls:  [][]string{{"a", "b", "c"}, {"b"}, {"b"}},
+			wantMarked: []int64{0},
+			wantErr:    ErrUnprocessed,
+		},
+		{
+			name:           "重试用完之后交给死信队列",
+			failures:       map[string]int{"b": 3},
+			deadLetter:     &fakeSink{},
+			wantCalls:      [][]string{{"a", "b", "c"}, {"b"}, {"b"}},
+			wantMarked:     []int64{0, 1, 2},
+			wantDeadLetter: []int64{1},
+		},
+		{
+			name:       "死信队列失败",
+			failures:   map[string]int{"b": 3},
+			deadLetter: &fakeSink{err: errMock},
+			wantCalls:  [][]string{{"a", "b", "c"}, {"b"}, {"b"}},
+			wantMarked: []int64{0},
+			wantErr:    ErrUnprocessed,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls [][]string
+			opts := []Option{WithCodec(RawCodec{}), WithBatchSize(3)}
+			if tc.deadLetter != nil {
+				opts = append(opts, WithDeadLetter(tc.deadLetter))
+			}
+			h := NewBatchResultHandler[string](logger.NewNopLogger(), func(ctx context.Context, msgs []*sarama.ConsumerMessage, ts []string) []error {
+				calls = append(calls, ts)
+				errs := make([]error, len(ts))
+				for i, val := range ts {
+					if tc.failures[val] > 0 {
+						tc.failures[val]--
+						errs[i] = errMock
+					}
+				}
+				return errs
+			}, opts...)
+			session := newFakeSession(t.Context())
+			err := h.ConsumeClaim(session, newFakeClaim("a", "b", "c"))
+			assert.ErrorIs(t, err, tc.wantErr)
+			assert.Equal(t, tc.wantCalls, calls)
+			assert.Equal(t, tc.wantMarked, session.Marked())
+			if tc.deadLetter != nil {
+				assert.Equal(t, tc.wantDeadLetter, tc.deadLetter.offsets)
+			}
+		})
+	}
+}
+
+func TestBatchHandler_Error(t *testing.T) {
+	// 整批失败的时候一条消息都不会被标记
+	h := NewBatchHandler[string](logger.NewNopLogger(), func(ctx context.Context, msgs []*sarama.ConsumerMessage, ts []string) error {
+		return errors.New("mock error")
+	}, WithCodec(RawCodec{}), WithBatchSize(2))
+	session := newFakeSession(t.Context())
+	err := h.ConsumeClaim(session, newFakeClaim("a", "b"))
+	assert.ErrorIs(t, err, ErrUnprocessed)
+	assert.Empty(t, session.Marked())
+}
+
+func TestBatchHandler_BatchDuration(t *testing.T) {
+	batches := make(chan []string, 10)
+	h := NewBatchHandler[string](logger.NewNopLogger(), func(ctx context.Context, msgs []*sarama.ConsumerMessage, ts []string) error {
+		batches <- ts
+		return nil
+	}, WithCodec(RawCodec{}), WithBatchSize(3), WithBatchDuration(100*time.Millisecond))
+
+	claim := &fakeClaim{msgs: make(chan *sarama.ConsumerMessage)}
+	session := newFakeSession(t.Context())
+	done := make(chan error, 1)
+	go func() {
+		done <- h.ConsumeClaim(session, claim)
+	}()
+
+	// 凑不满一批的时候等到超时
+	claim.send("a", "b")
+	assert.Equal(t, []string{"a", "b"}, <-batches)
+	// 超时之后的每一批都重新计时，不会退化成一条一批
+	for i := 0; i < 3; i++ {
+		time.Sleep(150 * time.Millisecond)
+		claim.send("c", "d", "e")
+		assert.Equal(t, []string{"c", "d", "e"}, <-batches)
+	}
+	claim.send("f")
+	assert.Equal(t, []string{"f"}, <-batches)
+	close(claim.msgs)
+	require.NoError(t, <-done)
+	assert.Len(t, session.Marked(), 12)
+}
+
+func TestBatchHandler_SessionCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	var gotCtx context.Context
+	h := NewBatchHandler[string](logger.NewNopLogger(), func(ctx context.Context, msgs []*sarama.ConsumerMessage, ts []string) error {
+		gotCtx = ctx
+		return nil
+	}, WithCodec(RawCodec{}), WithBatchSize(10), WithBatchDuration(time.Hour))
+
+	claim := &fakeClaim{msgs: make(chan *sarama.ConsumerMessage, 1)}
+	claim.send("a")
+	session := newFakeSession(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- h.ConsumeClaim(session, claim)
+	}()
+	// 凑批的时候消费者被关闭，不用等到超时，也不会处理和标记已经收到的消息
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("ConsumeClaim 没有退出")
+	}
+	assert.Nil(t, gotCtx)
+	assert.Empty(t, session.Marked())
+}
+
+func TestHandler_Context(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	session := newFakeSession(ctx)
+	var handled []string
+	h := NewHandler[string](logger.NewNopLogger(), func(ctx context.Context, msg *sarama.ConsumerMessage, val string) error {
+		// 业务收到的是 session 的 ctx，可以感知到消费者被关闭
+		assert.Equal(t, session.Context(), ctx)
+		handled = append(handled, val)
+		if val == "b" {
+			cancel()
+			return ctx.Err()
+		}
+		return nil
+	}, WithCodec(RawCodec{}))
+
+	err := h.ConsumeClaim(session, newFakeClaim("a", "b", "c"))
+	require.NoError(t, err)
+	// 消费者被关闭之后不再处理后面的消息，失败的消息也不会被标记
+	assert.Equal(t, []string{"a", "b"}, handled)
+	assert.Equal(t, []int64{0}, session.Marked())
+}
+
+func TestHandler_SucceededBeforeCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	session := newFakeSession(ctx)
+	var handled []string
+	h := NewHandler[string](logger.NewNopLogger(), func(ctx context.Context, msg *sarama.ConsumerMessage, val string) error {
+		handled = append(handled, val)
+		if val == "b" {
+			// 处理成功之后消费者才被关闭
+			cancel()
+		}
+		return nil
+	}, WithCodec(RawCodec{}))
+
+	err := h.ConsumeClaim(session, newFakeClaim("a", "b", "c"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, handled)
+	assert.Equal(t, []int64{0, 1}, session.Marked())
+}
+
+func TestBatchHandler_SucceededBeforeCanceled(t *testing.T) {
+	errMock := errors.New("mock error")
+	testCases := []struct {
+		name       string
+		failed     map[string]bool
+		wantMarked []int64
+	}{
+		{
+			name:       "全部成功",
+			wantMarked: []int64{0, 1, 2},
+		},
+		{
+			name:       "停在第一条失败的消息之前",
+			failed:     map[string]bool{"b": true},
+			wantMarked: []int64{0},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(t.Context())
+			h := NewBatchResultHandler[string](logger.NewNopLogger(), func(ctx context.Context, msgs []*sarama.ConsumerMessage, ts []string) []error {
+				// 处理完这一批之后消费者被关闭
+				cancel()
+				errs := make([]error, len(ts))
+				for i, val := range ts {
+					if tc.failed[val] {
+						errs[i] = errMock
+					}
+				}
+				return errs
+			}, WithCodec(RawCodec{}), WithBatchSize(3))
+			session := newFakeSession(ctx)
+			err := h.ConsumeClaim(session, newFakeClaim("a", "b", "c"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantMarked, session.Marked())
+		})
+	}
+}
+
+func TestBatchHandler_DecodeFailure(t *testing.T) {
+	testCases := []struct {
+		name       string
+		deadLetter *fakeSink
+
+		wantMarked     []int64
+		wantDeadLetter []int64
+		wantAttempts   []int
+		wantErr        error
+	}{
+		{
+			name:       "没有死信队列的时候停在反序列化失败的消息之前",
+			wantMarked: []int64{0},
+			wantErr:    ErrUnprocessed,
+		},
+		{
+			name:           "死信队列接收之后按照 offset 的顺序标记",
+			deadLetter:     &fakeSink{},
+			wantMarked:     []int64{0, 1, 2},
+			wantDeadLetter: []int64{1},
+			wantAttempts:   []int{0},
+		},
+		{
+			name:       "死信队列失败",
+			deadLetter: &fakeSink{err: errors.New("mock error")},
+			wantMarked: []int64{0},
+			wantErr:    ErrUnprocessed,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls [][]int
+			opts := []Option{WithBatchSize(3)}
+			if tc.deadLetter != nil {
+				opts = append(opts, WithDeadLetter(tc.deadLetter))
+			}
+			h := NewBatchHandler[int](logger.NewNopLogger(), func(ctx context.Context, msgs []*sarama.ConsumerMessage, ts []int) error {
+				calls = append(calls, ts)
+				return nil
+			}, opts...)
+			session := newFakeSession(t.Context())
+			err := h.ConsumeClaim(session, newFakeClaim("1", "bad", "3"))
+			assert.ErrorIs(t, err, tc.wantErr)
+			// 反序列化失败的消息不会交给业务
+			assert.Equal(t, [][]int{{1, 3}}, calls)
+			assert.Equal(t, tc.wantMarked, session.Marked())
+			if tc.deadLetter != nil {
+				assert.Equal(t, tc.wantDeadLetter, tc.deadLetter.offsets)
+				assert.Equal(t, tc.wantAttempts, tc.deadLetter.attempts)
+			}
+		})
+	}
+}
+
+func TestHandler_DeadLetter(t *testing.T) {
+	testCases := []struct {
+		name       string
+		deadLetter *fakeSink
+
+		wantMarked     []int64
+		wantDeadLetter []int64
+		wantAttempts   []int
+	}{
+		{
+			name:           "反序列化失败和重试用完的消息都交给死信队列并标记",
+			deadLetter:     &fakeSink{},
+			wantMarked:     []int64{0, 1, 2},
+			wantDeadLetter: []int64{0, 1},
+			// 反序列化失败的消息没有执行过，重试用完的一共执行了三次
+			wantAttempts: []int{0, 3},
+		},
+		{
+			name:       "死信队列失败的时候不标记",
+			deadLetter: &fakeSink{err: errors.New("mock error")},
+			wantMarked: []int64{2},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := NewHandler[int](logger.NewNopLogger(), func(ctx context.Context, msg *sarama.ConsumerMessage, val int) error {
+				if val == 1 {
+					return errors.New("mock error")
+				}
+				return nil
+			}, WithDeadLetter(tc.deadLetter))
+			session := newFakeSession(t.Context())
+			err := h.ConsumeClaim(session, newFakeClaim("bad", "1", "2"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantMarked, session.Marked())
+			assert.Equal(t, tc.wantDeadLetter, tc.deadLetter.offsets)
+			assert.Equal(t, tc.wantAttempts, tc.deadLetter.attempts)
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package saramax
+
+import (
+	"strings"
+
+	"github.com/IBM/sarama"
+)
+
+// Header 创建一个 header
+func Header(key, value string) sarama.RecordHeader {
+	return sarama.RecordHeader{Key: []byte(key), Value: []byte(value)}
+}
+
+// HeaderValue 查找消息里面的 header，key 不区分大小写
+func HeaderValue(headers []*sarama.RecordHeader, key string) (string, bool) {
+	for _, h := range headers {
+		if h != nil && strings.EqualFold(string(h.Key), key) {
+			return string(h.Value), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,114 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: types.go
+//
+// Generated by this command:
+//
+//	mockgen -source=types.go -package=saramaxmocks -destination=mocks/saramax_mock.go
+//
+
+// Package saramaxmocks is a generated GoMock package.
+package saramaxmocks
+
+import (
+	context "context"
+	reflect "reflect"
+
+	saramax "github.com/rermrf/emo/saramax"
+	gomock "go.uber.org/mock/gomock"
+)
+
+// MockConsumer is a mock of Consumer interface.
+type MockConsumer struct {
+	ctrl     *gomock.Controller
+	recorder *MockConsumerMockRecorder
+	isgomock struct{}
+}
+
+// MockConsumerMockRecorder is the mock recorder for MockConsumer.
+type MockConsumerMockRecorder struct {
+	mock *MockConsumer
+}
+
+// NewMockConsumer creates a new mock instance.
+func NewMockConsumer(ctrl *gomock.Controller) *MockConsumer {
+	mock := &MockConsumer{ctrl: ctrl}
+	mock.recorder = &MockConsumerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockConsumer) EXPECT() *MockConsumerMockRecorder {
+	return m.recorder
+}
+
+// Start mocks base method.
+func (m *MockConsumer) Start() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Start")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Start indicates an expected call of Start.
+func (mr *MockConsumerMockRecorder) Start() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Start", reflect.TypeOf((*MockConsumer)(nil).Start))
+}
+
+// MockProducer is a mock of Producer interface.
+type MockProducer[T any] struct {
+	ctrl     *gomock.Controller
+	recorder *MockProducerMockRecorder[T]
+	isgomock struct{}
+}
+
+// MockProducerMockRecorder is the mock recorder for MockProducer.
+type MockProducerMockRecorder[T any] struct {
+	mock *MockProducer[T]
+}
+
+// NewMockProducer creates a new mock instance.
+func NewMockProducer[T any](ctrl *gomock.Controller) *MockProducer[T] {
+	mock := &MockProducer[T]{ctrl: ctrl}
+	mock.recorder = &MockProducerMockRecorder[T]{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockProducer[T]) EXPECT() *MockProducerMockRecorder[T] {
+	return m.recorder
+}
+
+// Close mocks base method.
+func (m *MockProducer[T]) Close() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Close")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Close indicates an expected call of Close.
+func (mr *MockProducerMockRecorder[T]) Close() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockProducer[T])(nil).Close))
+}
+
+// Produce mocks base method.
+func (m *MockProducer[T]) Produce(ctx context.Context, val T, opts ...saramax.MessageOption) (saramax.Result, error) {
+	m.ctrl.T.Helper()
+	varargs := []any{ctx, val}
+	for _, a := range opts {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "Produce", varargs...)
+	ret0, _ := ret[0].(saramax.Result)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Produce indicates an expected call of Produce.
+func (mr *MockProducerMockRecorder[T]) Produce(ctx, val any, opts ...any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]any{ctx, val}, opts...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Produce", reflect.TypeOf((*MockProducer[T])(nil).Produce), varargs...)
+}
@@ -0,0 +1,104 @@
+package saramax
+
+import (
+	"time"
+
+	"github.com/rermrf/emo/batchsize"
+	"github.com/rermrf/emo/retry/strategy"
+)
+
+// Option Handler 和 BatchHandler 共用的配置项
+type Option func(o *options)
+
+type options struct {
+	codecs codecs
+	// 为 nil 的时候失败的消息只打日志
+	deadLetter DeadLetterSink
+	// 每条消息（批量消费的时候是每一批）创建一个新的 Strategy
+	retryStrategy func() strategy.Strategy
+
+	// 下面的配置只对 BatchHandler 生效
+	batchSize     int
+	batchDuration time.Duration
+	adjuster      batchsize.Adjuster
+}
+
+const (
+	defaultBatchSize     = 10
+	defaultBatchDuration = time.Second
+)
+
+func newOptions(opts []Option) options {
+	o := options{
+		codecs:        newCodecs(),
+		retryStrategy: defaultRetryStrategy,
+		batchSize:     defaultBatchSize,
+		batchDuration: defaultBatchDuration,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithCodec 设置默认的编码方式，默认是 JSONCodec
+func WithCodec(codec Codec) Option {
+	return func(o *options) {
+		o.codecs.defaultCodec = codec
+	}
+}
+
+// WithContentTypeCodecs 根据消息的 content-type header 选择编码方式，
+// 没有 header 或者 header 的值不认识的时候使用默认的编码方式
+func WithContentTypeCodecs(codecs ...Codec) Option {
+	return func(o *options) {
+		for _, codec := range codecs {
+			o.codecs.byType[codec.ContentType()] = codec
+		}
+	}
+}
+
+// WithDeadLetter 反序列化失败或者重试用完的消息发送到 sink，发送成功之后原始消息被标记为已经消费
+// 默认只打日志，并且不会标记消息
+func WithDeadLetter(sink DeadLetterSink) Option {
+	return func(o *options) {
+		o.deadLetter = sink
+	}
+}
+
+// WithRetryStrategy 设置业务处理失败之后的重试策略，每条消息调用一次 newStrategy 创建新的 Strategy
+// 默认一共执行三次，中间不等待
+func WithRetryStrategy(newStrategy func() strategy.Strategy) Option {
+	return func(o *options) {
+		o.retryStrategy = newStrategy
+	}
+}
+
+// WithBatchSize 设置 BatchHandler 每一批最多多少条消息，默认是 10，小于等于 0 的时候使用默认值
+// 设置了 WithBatchSizeAdjuster 的时候这是第一批的大小
+func WithBatchSize(size int) Option {
+	return func(o *options) {
+		if size <= 0 {
+			size = defaultBatchSize
+		}
+		o.batchSize = size
+	}
+}
+
+// WithBatchDuration 设置 BatchHandler 凑一批消息最多等待多久，默认是 1 秒，小于等于 0 的时候使用默认值
+func WithBatchDuration(duration time.Duration) Option {
+	return func(o *options) {
+		if duration <= 0 {
+			duration = defaultBatchDuration
+		}
+		o.batchDuration = duration
+	}
+}
+
+// WithBatchSizeAdjuster 每一批处理完之后把处理时间交给 adjuster，下一批使用 adjuster 返回的大小
+// 同一个 BatchHandler 的所有分区共用这个 adjuster，所以它需要是并发安全的，例如 batchsize.RingBufferAdjuster
+func WithBatchSizeAdjuster(adjuster batchsize.Adjuster) Option {
+	return func(o *options) {
+		o.adjuster = adjuster
+	}
+}
@@ -0,0 +1,256 @@
+package saramax
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/IBM/sarama"
+)
+
+var (
+	_ Producer[any] = (*SyncProducer[any])(nil)
+	_ Producer[any] = (*AsyncProducer[any])(nil)
+)
+
+// ErrProducerClosed 生产者已经被关闭
+var ErrProducerClosed = errors.New("saramax: 生产者已经关闭")
+
+// ProducerOption SyncProducer 和 AsyncProducer 的配置项
+type ProducerOption[T any] func(o *producerOptions[T])
+
+type producerOptions[T any] struct {
+	codec Codec
+	// 为 nil 的时候不设置 key，由 sarama 的分区策略决定分区
+	key func(val T) string
+	// 每条消息都会带上的 header
+	headers []sarama.RecordHeader
+}
+
+// WithProducerCodec 设置编码方式，默认是 JSONCodec，
+// 消息会带上 content-type header，消费者可以通过 WithContentTypeCodecs 自动选择编码方式
+func WithProducerCodec[T any](codec Codec) ProducerOption[T] {
+	return func(o *producerOptions[T]) {
+		o.codec = codec
+	}
+}
+
+// WithKeyFunc 从消息里面提取 key，同一个 key 的消息会被写到同一个分区
+// 返回空字符串的时候不设置 key，和没有 WithKeyFunc 一样由分区策略决定分区
+func WithKeyFunc[T any](key func(val T) string) ProducerOption[T] {
+	return func(o *producerOptions[T]) {
+		o.key = key
+	}
+}
+
+// WithProducerHeaders 每条消息都会带上的 header
+func WithProducerHeaders[T any](headers ...sarama.RecordHeader) ProducerOption[T] {
+	return func(o *producerOptions[T]) {
+		o.headers = append(o.headers, headers...)
+	}
+}
+
+// MessageOption 单条消息的配置项
+type MessageOption func(msg *sarama.ProducerMessage)
+
+// WithMessageKey 设置这条消息的 key，优先于 WithKeyFunc
+func WithMessageKey(key string) MessageOption {
+	return func(msg *sarama.ProducerMessage) {
+		msg.Key = sarama.StringEncoder(key)
+	}
+}
+
+// WithMessageHeaders 为这条消息追加 header
+func WithMessageHeaders(headers ...sarama.RecordHeader) MessageOption {
+	return func(msg *sarama.ProducerMessage) {
+		msg.Headers = append(msg.Headers, headers...)
+	}
+}
+
+// messageBuilder SyncProducer 和 AsyncProducer 共用的消息构造逻辑
+type messageBuilder[T any] struct {
+	topic string
+	producerOptions[T]
+}
+
+func newMessageBuilder[T any](topic string, opts []ProducerOption[T]) messageBuilder[T] {
+	b := messageBuilder[T]{
+		topic: topic,
+		producerOptions: producerOptions[T]{
+			codec: JSONCodec{},
+		},
+	}
+	for _, opt := range opts {
+		opt(&b.producerOptions)
+	}
+	return b
+}
+
+func (b messageBuilder[T]) build(val T, opts []MessageOption) (*sarama.ProducerMessage, error) {
+	data, err := b.codec.Encode(val)
+	if err != nil {
+		return nil, err
+	}
+	headers := make([]sarama.RecordHeader, 0, len(b.headers)+1)
+	headers = append(headers, Header(HeaderContentType, b.codec.ContentType()))
+	headers = append(headers, b.headers...)
+	msg := &sarama.ProducerMessage{
+		Topic:   b.topic,
+		Value:   sarama.ByteEncoder(data),
+		Headers: headers,
+	}
+	if b.key != nil {
+		if key := b.key(val); key != "" {
+			msg.Key = sarama.StringEncoder(key)
+		}
+	}
+	for _, opt := range opts {
+		opt(msg)
+	}
+	return msg, nil
+}
+
+// SyncProducer 同步发送，每条消息都等到写入成功之后才返回
+type SyncProducer[T any] struct {
+	producer sarama.SyncProducer
+	builder  messageBuilder[T]
+}
+
+// NewSyncProducer 消息都发送到 topic
+func NewSyncProducer[T any](producer sarama.SyncProducer, topic string, opts ...ProducerOption[T]) *SyncProducer[T] {
+	return &SyncProducer[T]{
+		producer: producer,
+		builder:  newMessageBuilder(topic, opts),
+	}
+}
+
+// Produce sarama.SyncProducer 不支持 ctx，只在发送之前检查 ctx 是否已经结束
+func (p *SyncProducer[T]) Produce(ctx context.Context, val T, opts ...MessageOption) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	msg, err := p.builder.build(val, opts)
+	if err != nil {
+		return Result{}, err
+	}
+	partition, offset, err := p.producer.SendMessage(msg)
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{Partition: partition, Offset: offset}, nil
+}
+
+func (p *SyncProducer[T]) Close() error {
+	return p.producer.Close()
+}
+
+// AsyncProducer 异步发送，sarama 会把并发发送的消息攒成批，吞吐量比 SyncProducer 高
+// sarama.AsyncProducer 的配置里面需要打开 Producer.Return.Successes 和 Producer.Return.Errors，
+// 否则拿不到发送的结果
+type AsyncProducer[T any] struct {
+	producer sarama.AsyncProducer
+	builder  messageBuilder[T]
+
+	mu     sync.RWMutex
+	closed bool
+	// Close 的时候关闭，唤醒阻塞在 Input 上的发送
+	done chan struct{}
+	// 正在往 Input 发送的调用，Close 等它们都返回之后才关闭 sarama，避免往关闭的 Input 发送
+	sending sync.WaitGroup
+	// 等待 Successes 和 Errors 处理完
+	wg sync.WaitGroup
+}
+
+func NewAsyncProducer[T any](producer sarama.AsyncProducer, topic string, opts ...ProducerOption[T]) *AsyncProducer[T] {
+	p := &AsyncProducer[T]{
+		producer: producer,
+		builder:  newMessageBuilder(topic, opts),
+		done:     make(chan struct{}),
+	}
+	p.wg.Add(2)
+	go func() {
+		defer p.wg.Done()
+		for msg := range producer.Successes() {
+			if callback, ok := msg.Metadata.(func(Result, error)); ok {
+				callback(Result{Partition: msg.Partition, Offset: msg.Offset}, nil)
+			}
+		}
+	}()
+	go func() {
+		defer p.wg.Done()
+		for err := range producer.Errors() {
+			if callback, ok := err.Msg.Metadata.(func(Result, error)); ok {
+				callback(Result{}, err.Err)
+			}
+		}
+	}()
+	return p
+}
+
+// Produce 等待发送结果，ctx 结束的时候直接返回，消息依旧可能被写入
+func (p *AsyncProducer[T]) Produce(ctx context.Context, val T, opts ...MessageOption) (Result, error) {
+	type result struct {
+		res Result
+		err error
+	}
+	ch := make(chan result, 1)
+	err := p.ProduceAsync(ctx, val, func(res Result, err error) {
+		ch <- result{res: res, err: err}
+	}, opts...)
+	if err != nil {
+		return Result{}, err
+	}
+	select {
+	case <-ctx.Done():
+		return Result{}, ctx.Err()
+	case r := <-ch:
+		return r.res, r.err
+	}
+}
+
+// ProduceAsync 把消息交给 sarama 之后就返回，callback 在写入成功或者失败之后被调用
+// callback 在 AsyncProducer 内部的 goroutine 里面执行，不能阻塞
+// 阻塞在发送上的时候 Close 会让它返回 ErrProducerClosed
+func (p *AsyncProducer[T]) ProduceAsync(ctx context.Context, val T, callback func(Result, error), opts ...MessageOption) error {
+	msg, err := p.builder.build(val, opts)
+	if err != nil {
+		return err
+	}
+	if callback != nil {
+		msg.Metadata = callback
+	}
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return ErrProducerClosed
+	}
+	p.sending.Add(1)
+	p.mu.RUnlock()
+	defer p.sending.Done()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.done:
+		return ErrProducerClosed
+	case p.producer.Input() <- msg:
+		return nil
+	}
+}
+
+// Close 等待已经交给 sarama 的消息发送完，并且所有的 callback 都执行完
+// 发送失败的消息通过 callback 返回，所以这里不会返回发送的错误
+func (p *AsyncProducer[T]) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	p.mu.Unlock()
+	p.sending.Wait()
+	// sarama 的 Close 会自己读 Successes 和 Errors，和这里的 goroutine 抢结果，所以使用 AsyncClose
+	p.producer.AsyncClose()
+	p.wg.Wait()
+	return nil
+}
@@ -0,0 +1,191 @@
+package saramax
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type order struct {
+	ID     string `json:"id"`
+	Amount int    `json:"amount"`
+}
+
+func TestSyncProducer(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	var sent *sarama.ProducerMessage
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		sent = msg
+		return nil
+	})
+	producer.ExpectSendMessageAndFail(errors.New("mock error"))
+
+	p := NewSyncProducer[order](producer, "orders",
+		WithKeyFunc(func(o order) string {
+			return o.ID
+		}),
+		WithProducerHeaders[order](Header("source", "test")))
+	t.Cleanup(func() {
+		require.NoError(t, p.Close())
+	})
+
+	res, err := p.Produce(t.Context(), order{ID: "o-1", Amount: 100}, WithMessageHeaders(Header("trace", "t-1")))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), res.Offset)
+
+	assert.Equal(t, "orders", sent.Topic)
+	key, _ := sent.Key.Encode()
+	assert.Equal(t, "o-1", string(key))
+	val, _ := sent.Value.Encode()
+	assert.JSONEq(t, `{"id":"o-1","amount":100}`, string(val))
+	headers := make([]*sarama.RecordHeader, 0, len(sent.Headers))
+	for i := range sent.Headers {
+		headers = append(headers, &sent.Headers[i])
+	}
+	for k, want := range map[string]string{HeaderContentType: "application/json", "source": "test", "trace": "t-1"} {
+		got, ok := HeaderValue(headers, k)
+		assert.True(t, ok, k)
+		assert.Equal(t, want, got, k)
+	}
+
+	_, err = p.Produce(t.Context(), order{ID: "o-2"})
+	assert.Error(t, err)
+}
+
+func TestSyncProducer_Protobuf(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	var sent *sarama.ProducerMessage
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		sent = msg
+		return nil
+	})
+	p := NewSyncProducer[*wrapperspb.StringValue](producer, "names",
+		WithProducerCodec[*wrapperspb.StringValue](ProtobufCodec{}))
+	_, err := p.Produce(t.Context(), wrapperspb.String("hello"), WithMessageKey("k"))
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+
+	// 消费者根据 content-type 选择 ProtobufCodec
+	val, _ := sent.Value.Encode()
+	msg := &sarama.ConsumerMessage{Value: val}
+	for i := range sent.Headers {
+		msg.Headers = append(msg.Headers, &sent.Headers[i])
+	}
+	o := newOptions([]Option{WithContentTypeCodecs(ProtobufCodec{})})
+	var got *wrapperspb.StringValue
+	require.NoError(t, o.codecs.decode(msg, &got))
+	assert.Equal(t, "hello", got.GetValue())
+	key, _ := sent.Key.Encode()
+	assert.Equal(t, "k", string(key))
+}
+
+func TestAsyncProducer(t *testing.T) {
+	cfg := mocks.NewTestConfig()
+	cfg.Producer.Return.Successes = true
+	producer := mocks.NewAsyncProducer(t, cfg)
+	producer.ExpectInputAndSucceed()
+	producer.ExpectInputAndFail(errors.New("mock error"))
+	producer.ExpectInputAndSucceed()
+
+	p := NewAsyncProducer[order](producer, "orders")
+
+	_, err := p.Produce(t.Context(), order{ID: "o-1"})
+	require.NoError(t, err)
+	_, err = p.Produce(t.Context(), order{ID: "o-2"})
+	assert.Error(t, err)
+
+	done := make(chan error, 1)
+	require.NoError(t, p.ProduceAsync(t.Context(), order{ID: "o-3"}, func(res Result, err error) {
+		done <- err
+	}))
+	require.NoError(t, p.Close())
+	// Close 之后 callback 一定已经执行完
+	select {
+	case err = <-done:
+		require.NoError(t, err)
+	default:
+		t.Fatal("callback 没有执行")
+	}
+
+	assert.ErrorIs(t, p.ProduceAsync(t.Context(), order{ID: "o-4"}, nil), ErrProducerClosed)
+}
+
+func TestProducer_EmptyKey(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	var sent *sarama.ProducerMessage
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		sent = msg
+		return nil
+	})
+	p := NewSyncProducer[order](producer, "orders", WithKeyFunc(func(o order) string {
+		return o.ID
+	}))
+	_, err := p.Produce(t.Context(), order{Amount: 100})
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+	// 空的 key 不设置，由分区策略决定分区，而不是全部写到空 key 对应的分区
+	assert.Nil(t, sent.Key)
+}
+
+// blockingAsyncProducer 没有人读 Input，发送会一直阻塞
+type blockingAsyncProducer struct {
+	sarama.AsyncProducer
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+}
+
+func newBlockingAsyncProducer() *blockingAsyncProducer {
+	return &blockingAsyncProducer{
+		input:     make(chan *sarama.ProducerMessage),
+		successes: make(chan *sarama.ProducerMessage),
+		errors:    make(chan *sarama.ProducerError),
+	}
+}
+
+func (p *blockingAsyncProducer) Input() chan<- *sarama.ProducerMessage {
+	return p.input
+}
+
+func (p *blockingAsyncProducer) Successes() <-chan *sarama.ProducerMessage {
+	return p.successes
+}
+
+func (p *blockingAsyncProducer) Errors() <-chan *sarama.ProducerError {
+	return p.errors
+}
+
+func (p *blockingAsyncProducer) AsyncClose() {
+	close(p.input)
+	close(p.successes)
+	close(p.errors)
+}
+
+func TestAsyncProducer_CloseWhileSending(t *testing.T) {
+	p := NewAsyncProducer[order](newBlockingAsyncProducer(), "orders")
+	sent := make(chan error, 1)
+	go func() {
+		sent <- p.ProduceAsync(t.Context(), order{ID: "o-1"}, nil)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// 阻塞的发送不会拖住 Close，Close 之后它返回 ErrProducerClosed
+	closed := make(chan error, 1)
+	go func() {
+		closed <- p.Close()
+	}()
+	select {
+	case err := <-closed:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Close 被阻塞的发送拖住了")
+	}
+	assert.ErrorIs(t, <-sent, ErrProducerClosed)
+	assert.ErrorIs(t, p.ProduceAsync(t.Context(), order{ID: "o-2"}, nil), ErrProducerClosed)
+}
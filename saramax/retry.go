@@ -0,0 +1,46 @@
+package saramax
+
+import (
+	"context"
+	"time"
+
+	"github.com/rermrf/emo/retry/strategy"
+)
+
+// defaultRetryStrategy 和之前的行为一致，一共执行三次，中间不等待
+func defaultRetryStrategy() strategy.Strategy {
+	return strategy.NewFixedIntervalRetryStrategy(0, 2)
+}
+
+// retry 按照 strategy 执行 fn，返回执行的次数和最后一次的错误
+// 每次失败都会调用 Report，返回的 Strategy 不再重试的时候直接结束，例如遇到了不可恢复的错误
+// 等待的过程中 ctx 被取消的时候返回 ctx.Err()
+func retry(ctx context.Context, newStrategy func() strategy.Strategy, fn func() error) (int, error) {
+	s := newStrategy()
+	attempts := 0
+	for {
+		attempts++
+		err := fn()
+		if err == nil {
+			return attempts, nil
+		}
+		s = s.Report(err)
+		interval, ok := s.Next()
+		if !ok {
+			return attempts, err
+		}
+		if interval <= 0 {
+			if ctx.Err() != nil {
+				return attempts, ctx.Err()
+			}
+			continue
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempts, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
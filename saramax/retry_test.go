@@ -0,0 +1,104 @@
+package saramax
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rermrf/emo/retry/strategy"
+	"github.com/stretchr/testify/assert"
+)
+
+var errPermanent = errors.New("permanent error")
+
+// permanentAware 遇到 errPermanent 之后不再重试
+type permanentAware struct {
+	strategy.Strategy
+}
+
+func (p permanentAware) Report(err error) strategy.Strategy {
+	if errors.Is(err, errPermanent) {
+		return noRetry{}
+	}
+	return p
+}
+
+type noRetry struct{}
+
+func (noRetry) NextWithRetries(retries int32) (time.Duration, bool) {
+	return 0, false
+}
+
+func (noRetry) Next() (time.Duration, bool) {
+	return 0, false
+}
+
+func (n noRetry) Report(err error) strategy.Strategy {
+	return n
+}
+
+func TestRetry(t *testing.T) {
+	errMock := errors.New("mock error")
+	testCases := []struct {
+		name         string
+		newStrategy  func() strategy.Strategy
+		errs         []error
+		ctx          func() context.Context
+		wantAttempts int
+		wantErr      error
+	}{
+		{
+			name:         "默认一共执行三次",
+			newStrategy:  defaultRetryStrategy,
+			errs:         []error{errMock, errMock, errMock, nil},
+			wantAttempts: 3,
+			wantErr:      errMock,
+		},
+		{
+			name:         "重试之后成功",
+			newStrategy:  defaultRetryStrategy,
+			errs:         []error{errMock, nil},
+			wantAttempts: 2,
+		},
+		{
+			name: "不可恢复的错误直接结束",
+			newStrategy: func() strategy.Strategy {
+				return permanentAware{Strategy: strategy.NewFixedIntervalRetryStrategy(time.Millisecond, 10)}
+			},
+			errs:         []error{errMock, errPermanent, nil},
+			wantAttempts: 2,
+			wantErr:      errPermanent,
+		},
+		{
+			name: "等待的时候 ctx 被取消",
+			newStrategy: func() strategy.Strategy {
+				return strategy.NewFixedIntervalRetryStrategy(time.Hour, 3)
+			},
+			errs: []error{errMock, nil},
+			ctx: func() context.Context {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+				t.Cleanup(cancel)
+				return ctx
+			},
+			wantAttempts: 1,
+			wantErr:      context.DeadlineExceeded,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.ctx != nil {
+				ctx = tc.ctx()
+			}
+			calls := 0
+			attempts, err := retry(ctx, tc.newStrategy, func() error {
+				err := tc.errs[calls]
+				calls++
+				return err
+			})
+			assert.Equal(t, tc.wantAttempts, attempts)
+			assert.ErrorIs(t, err, tc.wantErr)
+		})
+	}
+}
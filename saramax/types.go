@@ -1,5 +1,20 @@
 package saramax
 
+import "context"
+
 type Consumer interface {
 	Start() error
 }
+
+// Producer 发送 T 类型的消息
+type Producer[T any] interface {
+	// Produce 发送一条消息，等到写入成功之后返回写入的分区和 offset
+	Produce(ctx context.Context, val T, opts ...MessageOption) (Result, error)
+	Close() error
+}
+
+// Result 消息写入的位置
+type Result struct {
+	Partition int32
+	Offset    int64
+}